@@ -0,0 +1,156 @@
+package acl
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"accdns/network"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ActionAllow  = "allow"
+	ActionDeny   = "deny"
+	ActionRefuse = "refuse"
+)
+
+func Load(config *common.ConfigStruct, upstreams *network.Upstreams) (*RuleSet, error) {
+	action, err := parseAction(config.ACL.DefaultAction)
+	if err != nil {
+		return nil, err
+	}
+	ruleSet := &RuleSet{
+		defaultAction: action,
+		rules:         make([]*Rule, 0),
+		policyRules:   make([]*policyRule, 0),
+	}
+	for _, kvPair := range config.ACL.Rules {
+		actionStr, value, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return nil, err
+		}
+		action, err := parseAction(actionStr)
+		if err != nil {
+			return nil, err
+		}
+		cidrs, err := network.ParseCIDRSet([]string{value})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Load ACL Rule", action, value, cidrs.Len(), "ranges")
+		ruleSet.rules = append(ruleSet.rules, &Rule{Action: action, CIDRs: cidrs})
+	}
+	policies := make(map[string]*Policy)
+	for _, kvPair := range config.ACL.Policies {
+		name, value, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return nil, err
+		}
+		cidrs, err := network.ParseCIDRSet([]string{value})
+		if err != nil {
+			return nil, err
+		}
+		if policies[name] == nil {
+			policies[name] = &Policy{
+				Name:            name,
+				QueriesPerSec:   config.RateLimit.QueriesPerSec,
+				ResponsesPerSec: config.RateLimit.ResponsesPerSec,
+			}
+		}
+		logger.Info("Load ACL Policy "+name, value, cidrs.Len(), "ranges")
+		ruleSet.policyRules = append(ruleSet.policyRules, &policyRule{Policy: policies[name], CIDRs: cidrs})
+	}
+	for _, kvPair := range config.ACL.PolicyUpstreamGroup {
+		name, groupName, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return nil, err
+		}
+		if policies[name] == nil {
+			return nil, errors.New("acl policy \"" + name + "\" does not exist")
+		}
+		if _, ok := upstreams.Groups[groupName]; !ok {
+			return nil, errors.New("upstream group \"" + groupName + "\" of acl policy \"" + name + "\" does not exist")
+		}
+		policies[name].UpstreamGroup = groupName
+	}
+	for _, kvPair := range config.ACL.PolicyFilter {
+		name, value, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return nil, err
+		}
+		if policies[name] == nil {
+			return nil, errors.New("acl policy \"" + name + "\" does not exist")
+		}
+		enableFilter, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		policies[name].DisableFilter = !enableFilter
+	}
+	for _, kvPair := range config.ACL.PolicyQueriesPerSec {
+		name, value, err := parsePolicyRate(kvPair, policies)
+		if err != nil {
+			return nil, err
+		}
+		policies[name].QueriesPerSec = value
+	}
+	for _, kvPair := range config.ACL.PolicyResponsesPerSec {
+		name, value, err := parsePolicyRate(kvPair, policies)
+		if err != nil {
+			return nil, err
+		}
+		policies[name].ResponsesPerSec = value
+	}
+	return ruleSet, nil
+}
+
+func parsePolicyRate(kvPair string, policies map[string]*Policy) (string, int, error) {
+	name, value, err := common.ParseKVPair(kvPair)
+	if err != nil {
+		return "", 0, err
+	}
+	if policies[name] == nil {
+		return "", 0, errors.New("acl policy \"" + name + "\" does not exist")
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil {
+		return "", 0, err
+	}
+	if rate < 0 {
+		return "", 0, errors.New("rate \"" + value + "\" of acl policy \"" + name + "\" is not correct")
+	}
+	return name, rate, nil
+}
+
+func parseAction(action string) (string, error) {
+	switch strings.ToLower(action) {
+	case ActionAllow:
+		return ActionAllow, nil
+	case ActionDeny:
+		return ActionDeny, nil
+	case ActionRefuse:
+		return ActionRefuse, nil
+	}
+	return "", errors.New("acl action \"" + action + "\" is not supported")
+}
+
+func (ruleSet *RuleSet) Check(ip net.IP) (string, *Policy) {
+	action := ruleSet.defaultAction
+	for _, rule := range ruleSet.rules {
+		if rule.CIDRs.Contains(ip) {
+			action = rule.Action
+			break
+		}
+	}
+	if action != ActionAllow {
+		return action, nil
+	}
+	for _, rule := range ruleSet.policyRules {
+		if rule.CIDRs.Contains(ip) {
+			return action, rule.Policy
+		}
+	}
+	return action, nil
+}
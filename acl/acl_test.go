@@ -0,0 +1,133 @@
+package acl
+
+import (
+	"accdns/common"
+	"accdns/network"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestConfig(defaultAction string, rules ...string) *common.ConfigStruct {
+	return &common.ConfigStruct{
+		ACL:       &common.ACLConfig{DefaultAction: defaultAction, Rules: rules},
+		RateLimit: &common.RateLimitConfig{QueriesPerSec: 50, ResponsesPerSec: 10},
+	}
+}
+
+func newTestUpstreams() *network.Upstreams {
+	return &network.Upstreams{Groups: map[string][]*network.SocketAddr{"overseas": nil}}
+}
+
+func TestCheckMatchesCIDRs(t *testing.T) {
+	listPath := filepath.Join(t.TempDir(), "lab.txt")
+	if err := os.WriteFile(listPath, []byte("# lab hosts\n203.0.113.7\n2001:db8:1::/48 ; lab v6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig("refuse", "deny:192.168.1.128/25", "allow:192.168.0.0/16", "allow:10.0.0.1", "allow:"+listPath, "deny:::/0")
+	ruleSet, err := Load(config, newTestUpstreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		ip     string
+		action string
+	}{
+		{"192.168.1.127", ActionAllow},
+		{"192.168.1.128", ActionDeny},
+		{"192.168.1.255", ActionDeny},
+		{"192.168.255.255", ActionAllow},
+		{"192.169.0.0", ActionRefuse},
+		{"10.0.0.1", ActionAllow},
+		{"10.0.0.2", ActionRefuse},
+		{"::ffff:10.0.0.1", ActionAllow},
+		{"203.0.113.7", ActionAllow},
+		{"2001:db8:1:ffff::1", ActionAllow},
+		{"2001:db8:2::1", ActionDeny},
+		{"172.16.0.1", ActionRefuse},
+	}
+	for _, testCase := range testCases {
+		if action, _ := ruleSet.Check(net.ParseIP(testCase.ip)); action != testCase.action {
+			t.Errorf("Check(%s) = %s, want %s", testCase.ip, action, testCase.action)
+		}
+	}
+}
+
+func TestCheckAssignsPolicies(t *testing.T) {
+	config := newTestConfig("allow", "deny:192.168.2.66")
+	config.ACL.Policies = []string{"kids:192.168.2.0/24", "lab:192.168.0.0/16", "kids:2001:db8::/32"}
+	config.ACL.PolicyUpstreamGroup = []string{"kids:overseas"}
+	config.ACL.PolicyFilter = []string{"lab:false"}
+	config.ACL.PolicyQueriesPerSec = []string{"kids:20"}
+	config.ACL.PolicyResponsesPerSec = []string{"lab:0"}
+	ruleSet, err := Load(config, newTestUpstreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	action, policy := ruleSet.Check(net.ParseIP("192.168.2.10"))
+	if action != ActionAllow || policy == nil || policy.Name != "kids" || policy.UpstreamGroup != "overseas" || policy.DisableFilter || policy.QueriesPerSec != 20 || policy.ResponsesPerSec != 10 {
+		t.Fatalf("got %s %+v, want the kids policy", action, policy)
+	}
+	if _, v6Policy := ruleSet.Check(net.ParseIP("2001:db8::5")); v6Policy != policy {
+		t.Fatalf("got %+v, want the same kids policy for its ipv6 range", v6Policy)
+	}
+	_, policy = ruleSet.Check(net.ParseIP("192.168.3.10"))
+	if policy == nil || policy.Name != "lab" || !policy.DisableFilter || policy.QueriesPerSec != 50 || policy.ResponsesPerSec != 0 {
+		t.Fatalf("got %+v, want the lab policy", policy)
+	}
+	if action, policy := ruleSet.Check(net.ParseIP("192.168.2.66")); action != ActionDeny || policy != nil {
+		t.Fatalf("got %s %+v, want deny without a policy", action, policy)
+	}
+	if _, policy := ruleSet.Check(net.ParseIP("172.16.0.1")); policy != nil {
+		t.Fatalf("got %+v, want no policy", policy)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := map[string]func(*common.ConfigStruct){
+		"default action": func(config *common.ConfigStruct) { config.ACL.DefaultAction = "block" },
+		"rule action":    func(config *common.ConfigStruct) { config.ACL.Rules = []string{"block:10.0.0.0/8"} },
+		"rule cidr":      func(config *common.ConfigStruct) { config.ACL.Rules = []string{"allow:10.0.0.0/33"} },
+		"policy group": func(config *common.ConfigStruct) {
+			config.ACL.Policies = []string{"kids:10.0.0.0/8"}
+			config.ACL.PolicyUpstreamGroup = []string{"kids:missing"}
+		},
+		"missing policy": func(config *common.ConfigStruct) { config.ACL.PolicyFilter = []string{"kids:false"} },
+		"negative rate": func(config *common.ConfigStruct) {
+			config.ACL.Policies = []string{"kids:10.0.0.0/8"}
+			config.ACL.PolicyQueriesPerSec = []string{"kids:-1"}
+		},
+	}
+	for name, modify := range testCases {
+		config := newTestConfig("allow")
+		modify(config)
+		if _, err := Load(config, newTestUpstreams()); err == nil {
+			t.Errorf("%s: acl loaded without error", name)
+		}
+	}
+}
+
+func TestIPv6RangesSkipIPv4Clients(t *testing.T) {
+	cidrs, err := network.ParseCIDRSet([]string{"::/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"::", "::fffe:ffff:ffff", "::1:0:0:0", "2001:db8::1", "ffff::1"} {
+		if !cidrs.Contains(net.ParseIP(ip)) {
+			t.Errorf("::/0 does not contain %s", ip)
+		}
+	}
+	for _, ip := range []string{"0.0.0.0", "192.0.2.1", "255.255.255.255"} {
+		if cidrs.Contains(net.ParseIP(ip)) {
+			t.Errorf("::/0 contains ipv4 client %s", ip)
+		}
+	}
+	mapped, err := network.ParseCIDRSet([]string{"::ffff:192.0.2.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mapped.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("ipv4-mapped range does not contain its ipv4 client")
+	}
+}
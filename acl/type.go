@@ -0,0 +1,29 @@
+package acl
+
+import (
+	"accdns/network"
+)
+
+type RuleSet struct {
+	defaultAction string
+	rules         []*Rule
+	policyRules   []*policyRule
+}
+
+type Rule struct {
+	Action string
+	CIDRs  *network.CIDRSet
+}
+
+type Policy struct {
+	Name            string
+	UpstreamGroup   string
+	DisableFilter   bool
+	QueriesPerSec   int
+	ResponsesPerSec int
+}
+
+type policyRule struct {
+	Policy *Policy
+	CIDRs  *network.CIDRSet
+}
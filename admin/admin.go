@@ -0,0 +1,316 @@
+package admin
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/diversion"
+	"accdns/logger"
+	"accdns/metrics"
+	"accdns/stats"
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultStatsTop = 10
+const defaultRecentQueriesLimit = 100
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 60 * time.Second
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func Start(dnsCache *cache.Cache, reloadConfig func() error) (*Server, error) {
+	if common.Config.Admin.ListenAddr == "" {
+		return nil, nil
+	}
+	if common.Config.Admin.Token == "" {
+		return nil, errors.New("admin token is not set")
+	}
+	listener, err := listen(common.Config.Admin.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
+		Cache:        dnsCache,
+		Token:        common.Config.Admin.Token,
+		ReloadConfig: reloadConfig,
+		listener:     listener,
+		mux:          http.NewServeMux(),
+	}
+	server.mux.HandleFunc("/cache/entries", server.authorize(server.handleCacheEntries))
+	server.mux.HandleFunc("/cache/purge", server.authorize(server.handleCachePurge))
+	server.mux.HandleFunc("/cache/purge-suffix", server.authorize(server.handleCachePurgeSuffix))
+	server.mux.HandleFunc("/cache/flush", server.authorize(server.handleCacheFlush))
+	server.mux.HandleFunc("/metrics", server.authorize(server.handleMetrics))
+	server.mux.HandleFunc("/stats", server.authorize(server.handleStats))
+	server.mux.HandleFunc("/stats/queries", server.authorize(server.handleRecentQueries))
+	server.mux.HandleFunc("/filter/reload", server.authorize(server.handleFilterReload))
+	server.mux.HandleFunc("/config/reload", server.authorize(server.handleConfigReload))
+	server.mux.HandleFunc("/", server.handleDashboard)
+	server.httpServer = &http.Server{
+		Handler:           server.mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	logger.Alert("Admin", "listen on", common.Config.Admin.ListenAddr)
+	go func() {
+		if err := server.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Admin Serve", err)
+		}
+	}()
+	return server, nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		socketPath := addr[5:]
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (server *Server) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.httpServer.Shutdown(ctx)
+}
+
+func (server *Server) Close() error {
+	return server.httpServer.Close()
+}
+
+func (server *Server) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(authorization[len("Bearer "):]), []byte(server.Token)) != 1 {
+			logger.Warning("Admin Authorize", "reject request from", r.RemoteAddr, r.URL.Path)
+			writeJSON(w, http.StatusUnauthorized, &errorResponse{Error: "unauthorized"})
+			return
+		}
+		if common.NeedDebug() {
+			logger.Debug("Admin Request", r.RemoteAddr, r.Method, r.URL.String())
+		}
+		handler(w, r)
+	}
+}
+
+func (server *Server) handleCacheEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if server.Cache == nil {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "cache is disabled"})
+		return
+	}
+	entries := server.Cache.Entries()
+	if name := r.URL.Query().Get("name"); name != "" {
+		name = cache.NormalizeName(name)
+		filteredEntries := make([]*cache.EntryInfo, 0)
+		for _, entry := range entries {
+			if cache.NormalizeName(entry.Name) == name {
+				filteredEntries = append(filteredEntries, entry)
+			}
+		}
+		entries = filteredEntries
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (server *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if server.Cache == nil {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "cache is disabled"})
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{Error: "name is required"})
+		return
+	}
+	qType := dnsmessage.Type(0)
+	if typeStr := r.URL.Query().Get("type"); typeStr != "" {
+		var err error
+		qType, err = common.ParseRecordType(typeStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &errorResponse{Error: err.Error()})
+			return
+		}
+	}
+	count := server.Cache.Purge(name, qType)
+	logger.Info("Admin Purge Cache", name, typeString(qType), "purged", count)
+	writeJSON(w, http.StatusOK, &purgeResponse{Purged: count})
+}
+
+func (server *Server) handleCachePurgeSuffix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if server.Cache == nil {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "cache is disabled"})
+		return
+	}
+	suffix := r.URL.Query().Get("suffix")
+	if suffix == "" {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{Error: "suffix is required"})
+		return
+	}
+	count := server.Cache.PurgeSuffix(suffix)
+	logger.Info("Admin Purge Cache by Suffix", suffix, "purged", count)
+	writeJSON(w, http.StatusOK, &purgeResponse{Purged: count})
+}
+
+func (server *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if server.Cache == nil {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "cache is disabled"})
+		return
+	}
+	count := server.Cache.Flush()
+	logger.Info("Admin Flush Cache", "purged", count)
+	writeJSON(w, http.StatusOK, &purgeResponse{Purged: count})
+}
+
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(metrics.Text()); err != nil {
+		logger.Warning("Write Admin Response", err)
+	}
+}
+
+func (server *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if !stats.Enabled() {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "stats are disabled"})
+		return
+	}
+	top := defaultStatsTop
+	if topStr := r.URL.Query().Get("top"); topStr != "" {
+		var err error
+		top, err = strconv.Atoi(topStr)
+		if err != nil || top < 1 {
+			writeJSON(w, http.StatusBadRequest, &errorResponse{Error: "top is not correct"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, stats.GetReport(top))
+}
+
+func (server *Server) handleRecentQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if !stats.Enabled() {
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: "stats are disabled"})
+		return
+	}
+	limit := defaultRecentQueriesLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			writeJSON(w, http.StatusBadRequest, &errorResponse{Error: "limit is not correct"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, stats.RecentQueries(r.URL.Query().Get("search"), limit))
+}
+
+func (server *Server) handleFilterReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	count, err := diversion.ReloadFilter()
+	if err != nil {
+		logger.Warning("Admin Reload Filter Lists", err)
+		writeJSON(w, http.StatusServiceUnavailable, &errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &reloadResponse{Rules: count})
+}
+
+func (server *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	if err := server.ReloadConfig(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, &errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &statusResponse{Status: "reloaded"})
+}
+
+func (server *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeJSON(w, http.StatusNotFound, &errorResponse{Error: "not found"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(dashboardHTML); err != nil {
+		logger.Warning("Write Admin Response", err)
+	}
+}
+
+func typeString(qType dnsmessage.Type) string {
+	if qType == dnsmessage.Type(0) {
+		return "ALL"
+	}
+	return qType.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warning("Write Admin Response", err)
+	}
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeRequiresBearerToken(t *testing.T) {
+	server := &Server{Token: "secret"}
+	handler := server.authorize(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	testCases := map[string]int{
+		"":               http.StatusUnauthorized,
+		"secret":         http.StatusUnauthorized,
+		"bearer secret":  http.StatusUnauthorized,
+		"Bearer  secret": http.StatusUnauthorized,
+		"Bearer secret2": http.StatusUnauthorized,
+		"Bearer":         http.StatusUnauthorized,
+		"Basic c2VjcmV0": http.StatusUnauthorized,
+		"Bearer secret":  http.StatusNoContent,
+	}
+	for authorization, status := range testCases {
+		request := httptest.NewRequest(http.MethodGet, "/cache/entries", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("authorization %q got status %d, want %d", authorization, recorder.Code, status)
+		}
+	}
+}
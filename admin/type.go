@@ -0,0 +1,32 @@
+package admin
+
+import (
+	"accdns/cache"
+	"net"
+	"net/http"
+)
+
+type Server struct {
+	Cache        *cache.Cache
+	Token        string
+	ReloadConfig func() error
+	listener     net.Listener
+	mux          *http.ServeMux
+	httpServer   *http.Server
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+type reloadResponse struct {
+	Rules int `json:"rules"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
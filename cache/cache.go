@@ -6,10 +6,24 @@ import (
 	"accdns/network"
 	"errors"
 	"golang.org/x/net/dns/dnsmessage"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	StatusHit   = "hit"
+	StatusStale = "stale"
+	StatusMiss  = "miss"
+)
+
 func (dnsCache *Cache) UpdateItem(item *Item, msg *dnsmessage.Message) {
+	if data := dnsCache.newItemData(msg); data != nil {
+		item.data.Store(data)
+		atomic.StoreInt64(&item.Hits, 0)
+	}
+}
+
+func (dnsCache *Cache) newItemData(msg *dnsmessage.Message) *itemData {
 	if msg.Header.RCode == dnsmessage.RCodeSuccess && msg.Header.Truncated == false && len(msg.Answers) > 0 {
 		itemTTL := dnsCache.MaxTTL
 		for _, res := range msg.Answers {
@@ -39,42 +53,135 @@ func (dnsCache *Cache) UpdateItem(item *Item, msg *dnsmessage.Message) {
 				}
 			}
 		}
-		item.Msg = msg
-		item.TTL = itemTTL
-		item.UpdateAt = time.Now().UnixNano()
+		return &itemData{
+			Msg:      msg,
+			TTL:      itemTTL,
+			UpdateAt: time.Now().UnixNano(),
+		}
 	}
+	return nil
 }
 
-func (dnsCache *Cache) QueryAndUpdate(queryMsg *dnsmessage.Message, upstream *network.SocketAddr, updateFunc func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error)) (*dnsmessage.Message, error) {
+func (dnsCache *Cache) QueryAndUpdate(queryMsg *dnsmessage.Message, route string, upstream *network.SocketAddr, updateFunc func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error)) (*dnsmessage.Message, string, error) {
 	if queryMsg == nil || len(queryMsg.Questions) < 1 {
-		return nil, errors.New("wrong dns message")
+		return nil, "", errors.New("wrong dns message")
 	}
 	question := &queryMsg.Questions[0]
-	key := question.Name.String() + "|" + question.Class.String() + "|" + question.Type.String()
-	var item *Item
-	rawItem, ok := dnsCache.cacheMap.Load(key)
-	if ok && rawItem != nil {
-		item = rawItem.(*Item)
-		if item.Msg != nil && time.Now().UnixNano() < item.UpdateAt+(time.Duration(item.TTL)*time.Second).Nanoseconds() {
+	key, hash := makeItemKey(queryMsg, route)
+	itemShard := dnsCache.shardOf(hash)
+	if item := itemShard.load(&key); item != nil {
+		data := item.data.Load()
+		now := time.Now().UnixNano()
+		if now < data.ExpireAt() {
 			if common.NeedDebug() {
 				logger.Debug("Cache Hit", question.Name, question.Class, question.Type)
 			}
-			return item.Msg, nil
+			atomic.AddUint64(&dnsCache.hits, 1)
+			hits := atomic.AddInt64(&item.Hits, 1)
+			if dnsCache.Prefetch && hits >= int64(dnsCache.PrefetchMinHits) && data.ExpireAt()-now <= (time.Duration(data.TTL)*time.Second).Nanoseconds()*int64(dnsCache.PrefetchThresholdPercent)/100 {
+				if dnsCache.refreshItem(item, queryMsg, upstream, updateFunc) != nil && common.NeedDebug() {
+					logger.Debug("Cache Prefetch", question.Name, question.Class, question.Type, "hits", hits)
+				}
+			}
+			return data.Msg, StatusHit, nil
+		}
+		if dnsCache.ServeStale && now < data.ExpireAt()+dnsCache.staleWindow() {
+			if common.NeedDebug() {
+				logger.Debug("Cache Stale", question.Name, question.Class, question.Type)
+			}
+			atomic.AddUint64(&dnsCache.staleHits, 1)
+			msg, status := dnsCache.refreshStaleItem(item, data.Msg, queryMsg, upstream, updateFunc)
+			return msg, status, nil
 		}
 		if common.NeedDebug() {
 			logger.Debug("Cache Invalid", question.Name, question.Class, question.Type)
 		}
-	} else {
-		item = &Item{}
-		dnsCache.cacheMap.Store(key, item)
 	}
 	if common.NeedDebug() {
 		logger.Debug("Cache Miss", question.Name, question.Class, question.Type)
 	}
-	msg, err := updateFunc(queryMsg, upstream)
-	if err != nil {
-		return nil, err
+	atomic.AddUint64(&dnsCache.misses, 1)
+	msg, err := dnsCache.flights.Do(key.String()+"|"+upstream.String(), func() (*dnsmessage.Message, error) {
+		msg, err := updateFunc(queryMsg, upstream)
+		if err != nil {
+			return nil, err
+		}
+		if data := dnsCache.newItemData(msg); data != nil {
+			itemShard.storeData(&key, question, data)
+		}
+		return msg, nil
+	})
+	return msg, StatusMiss, err
+}
+
+func Key(queryMsg *dnsmessage.Message, route string) string {
+	key, _ := makeItemKey(queryMsg, route)
+	return key.String()
+}
+
+func (dnsCache *Cache) refreshStaleItem(item *Item, staleMsg *dnsmessage.Message, queryMsg *dnsmessage.Message, upstream *network.SocketAddr, updateFunc func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error)) (*dnsmessage.Message, string) {
+	resultChan := dnsCache.refreshItem(item, queryMsg, upstream, updateFunc)
+	if resultChan == nil {
+		return dnsCache.staleCopy(staleMsg), StatusStale
+	}
+	timer := time.NewTimer(time.Duration(dnsCache.StaleClientTimeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case msg := <-resultChan:
+		if msg != nil {
+			return msg, StatusMiss
+		}
+	case <-timer.C:
 	}
-	dnsCache.UpdateItem(item, msg)
-	return msg, nil
+	if common.NeedDebug() {
+		logger.Debug("Serve Stale", queryMsg.Questions[0].Name, queryMsg.Questions[0].Type)
+	}
+	return dnsCache.staleCopy(staleMsg), StatusStale
+}
+
+func (dnsCache *Cache) refreshItem(item *Item, queryMsg *dnsmessage.Message, upstream *network.SocketAddr, updateFunc func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error)) <-chan *dnsmessage.Message {
+	if !atomic.CompareAndSwapInt32(&item.refreshing, 0, 1) {
+		return nil
+	}
+	resultChan := make(chan *dnsmessage.Message, 1)
+	go func() {
+		defer atomic.StoreInt32(&item.refreshing, 0)
+		msg, err := updateFunc(queryMsg, upstream)
+		if err != nil {
+			logger.Warning("Refresh Cache", queryMsg.Questions[0].Name, err)
+			resultChan <- nil
+			return
+		}
+		if msg.Header.RCode == dnsmessage.RCodeServerFailure || msg.Header.RCode == dnsmessage.RCodeRefused {
+			logger.Warning("Refresh Cache", queryMsg.Questions[0].Name, msg.Header.RCode)
+			resultChan <- nil
+			return
+		}
+		dnsCache.UpdateItem(item, msg)
+		resultChan <- msg
+	}()
+	return resultChan
+}
+
+func (dnsCache *Cache) staleCopy(msg *dnsmessage.Message) *dnsmessage.Message {
+	staleMsg := *msg
+	staleMsg.Answers = resourcesWithTTL(msg.Answers, uint32(dnsCache.StaleAnswerTTL))
+	staleMsg.Authorities = resourcesWithTTL(msg.Authorities, uint32(dnsCache.StaleAnswerTTL))
+	staleMsg.Additionals = resourcesWithTTL(msg.Additionals, uint32(dnsCache.StaleAnswerTTL))
+	return &staleMsg
+}
+
+func resourcesWithTTL(resources []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	newResources := make([]dnsmessage.Resource, len(resources))
+	for i, res := range resources {
+		newResources[i] = res
+		if res.Header.Type != dnsmessage.TypeOPT {
+			newResources[i].Header.TTL = ttl
+		}
+	}
+	return newResources
+}
+
+func (data *itemData) ExpireAt() int64 {
+	return data.UpdateAt + (time.Duration(data.TTL) * time.Second).Nanoseconds()
 }
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"accdns/common"
+	"accdns/network"
+	"encoding/hex"
+	"golang.org/x/net/dns/dnsmessage"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchKeys = 4096
+
+type syncMapCache struct {
+	items   sync.Map
+	flights FlightGroup
+	cache   Cache
+}
+
+type syncMapItem struct {
+	Question dnsmessage.Question
+	Route    string
+	Hits     int64
+	data     atomic.Pointer[itemData]
+}
+
+func syncMapKey(queryMsg *dnsmessage.Message, route string) string {
+	question := &queryMsg.Questions[0]
+	flags := ""
+	if queryMsg.Header.CheckingDisabled {
+		flags += "CD"
+	}
+	ecsScope := ""
+	for _, res := range queryMsg.Additionals {
+		if res.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		if res.Header.DNSSECAllowed() {
+			flags += "DO"
+		}
+		if optRes, ok := res.Body.(*dnsmessage.OPTResource); ok {
+			for _, option := range optRes.Options {
+				if option.Code == common.EDNSOptionCodeClientSubnet {
+					ecsScope = hex.EncodeToString(option.Data)
+				}
+			}
+		}
+	}
+	return strings.ToLower(question.Name.String()) + "|" + question.Class.String() + "|" + question.Type.String() + "|" + route + "|" + flags + "|" + ecsScope
+}
+
+func (dnsCache *syncMapCache) QueryAndUpdate(queryMsg *dnsmessage.Message, route string, upstream *network.SocketAddr, updateFunc func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error)) (*dnsmessage.Message, error) {
+	question := &queryMsg.Questions[0]
+	key := syncMapKey(queryMsg, route)
+	rawItem, loaded := dnsCache.items.LoadOrStore(key, &syncMapItem{Question: *question, Route: route})
+	item := rawItem.(*syncMapItem)
+	if data := item.data.Load(); loaded && data != nil && time.Now().UnixNano() < data.ExpireAt() {
+		atomic.AddInt64(&item.Hits, 1)
+		return data.Msg, nil
+	}
+	return dnsCache.flights.Do(key+"|"+upstream.String(), func() (*dnsmessage.Message, error) {
+		msg, err := updateFunc(queryMsg, upstream)
+		if err != nil {
+			return nil, err
+		}
+		if data := dnsCache.cache.newItemData(msg); data != nil {
+			item.data.Store(data)
+			atomic.StoreInt64(&item.Hits, 0)
+		}
+		return msg, nil
+	})
+}
+
+func newBenchQueries(prefix string, count int) []*dnsmessage.Message {
+	queries := make([]*dnsmessage.Message, count)
+	for i := range queries {
+		queries[i] = newTestQuery(prefix + strconv.Itoa(i) + ".example.")
+	}
+	return queries
+}
+
+func runBenchmark(b *testing.B, missEvery uint64, query func(*dnsmessage.Message) error) {
+	queries := newBenchQueries("host", benchKeys)
+	for _, queryMsg := range queries {
+		if err := query(queryMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	missQueries := newBenchQueries("miss", 1<<16)
+	counter := uint64(0)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddUint64(&counter, 1)
+			queryMsg := queries[n%benchKeys]
+			if missEvery > 0 && n%missEvery == 0 {
+				queryMsg = missQueries[(n/missEvery)%uint64(len(missQueries))]
+			}
+			if err := query(queryMsg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchmarkShardedCache(b *testing.B, shards int, missEvery uint64) {
+	dnsCache := &Cache{Shards: shards, MaxTTL: 3600}
+	upstream := newTestUpstream(b)
+	updateFunc := answerUpdate(3600)
+	runBenchmark(b, missEvery, func(queryMsg *dnsmessage.Message) error {
+		_, _, err := dnsCache.QueryAndUpdate(queryMsg, "default", upstream, updateFunc)
+		return err
+	})
+}
+
+func benchmarkSyncMapCache(b *testing.B, missEvery uint64) {
+	dnsCache := &syncMapCache{cache: Cache{MaxTTL: 3600}}
+	upstream := newTestUpstream(b)
+	updateFunc := answerUpdate(3600)
+	runBenchmark(b, missEvery, func(queryMsg *dnsmessage.Message) error {
+		_, err := dnsCache.QueryAndUpdate(queryMsg, "default", upstream, updateFunc)
+		return err
+	})
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	b.Run("Sharded1", func(b *testing.B) { benchmarkShardedCache(b, 1, 0) })
+	b.Run("Sharded64", func(b *testing.B) { benchmarkShardedCache(b, 64, 0) })
+	b.Run("SyncMap", func(b *testing.B) { benchmarkSyncMapCache(b, 0) })
+}
+
+func BenchmarkCacheMixed(b *testing.B) {
+	b.Run("Sharded1", func(b *testing.B) { benchmarkShardedCache(b, 1, 10) })
+	b.Run("Sharded64", func(b *testing.B) { benchmarkShardedCache(b, 64, 10) })
+	b.Run("SyncMap", func(b *testing.B) { benchmarkSyncMapCache(b, 10) })
+}
@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"accdns/network"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestQuery(name string) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+}
+
+func newTestAnswer(queryMsg *dnsmessage.Message, ttl uint32, last byte) *dnsmessage.Message {
+	question := queryMsg.Questions[0]
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{question},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}},
+		}},
+	}
+}
+
+func newTestUpstream(t testing.TB) *network.SocketAddr {
+	upstream, err := network.ParseNewSocketAddr("127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+var errTestUpstream = errors.New("upstream is unreachable")
+
+func failingUpdate(msg *dnsmessage.Message, upstream *network.SocketAddr) (*dnsmessage.Message, error) {
+	return nil, errTestUpstream
+}
+
+func answerUpdate(ttl uint32) func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error) {
+	return func(msg *dnsmessage.Message, upstream *network.SocketAddr) (*dnsmessage.Message, error) {
+		return newTestAnswer(msg, ttl, 1), nil
+	}
+}
+
+func itemOf(dnsCache *Cache, queryMsg *dnsmessage.Message) *Item {
+	key, hash := makeItemKey(queryMsg, "default")
+	return dnsCache.shardOf(hash).load(&key)
+}
+
+func blockingUpdate(releaseChan chan struct{}) func(*dnsmessage.Message, *network.SocketAddr) (*dnsmessage.Message, error) {
+	return func(msg *dnsmessage.Message, upstream *network.SocketAddr) (*dnsmessage.Message, error) {
+		<-releaseChan
+		return newTestAnswer(msg, 100, 2), nil
+	}
+}
+
+func newPrefetchCache(t *testing.T, queryMsg *dnsmessage.Message, minHits int) *Cache {
+	dnsCache := &Cache{
+		MaxTTL:                   3600,
+		Prefetch:                 true,
+		PrefetchMinHits:          minHits,
+		PrefetchThresholdPercent: 10,
+	}
+	if _, _, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), answerUpdate(100)); err != nil {
+		t.Fatal(err)
+	}
+	return dnsCache
+}
+
+func TestPrefetchBelowThreshold(t *testing.T) {
+	queryMsg := newTestQuery("prefetch.example.")
+	dnsCache := newPrefetchCache(t, queryMsg, 1)
+	releaseChan := make(chan struct{})
+	item := itemOf(dnsCache, queryMsg)
+	for i := 0; i < 3; i++ {
+		if _, status, _ := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), blockingUpdate(releaseChan)); status != StatusHit {
+			t.Fatalf("got status %q, want hit", status)
+		}
+	}
+	if atomic.LoadInt32(&item.refreshing) != 0 {
+		t.Fatal("entry with 100% of its ttl left was prefetched")
+	}
+	if hits := dnsCache.Entries()[0].Hits; hits != 3 {
+		t.Fatalf("got %d hits, want 3", hits)
+	}
+	backdate(dnsCache, queryMsg, 91*time.Second)
+	msg, status, _ := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), blockingUpdate(releaseChan))
+	if status != StatusHit || msg.Answers[0].Body.(*dnsmessage.AResource).A[3] != 1 {
+		t.Fatalf("got status %q with answer %v, want the cached answer", status, msg.Answers[0].Body)
+	}
+	if atomic.LoadInt32(&item.refreshing) != 1 {
+		t.Fatal("entry with 9% of its ttl left was not prefetched")
+	}
+	close(releaseChan)
+	if entry := waitRefreshed(t, dnsCache, 90); entry.Hits != 0 {
+		t.Fatalf("got %d hits after prefetch, want 0", entry.Hits)
+	}
+}
+
+func TestPrefetchRequiresMinHits(t *testing.T) {
+	queryMsg := newTestQuery("prefetch.example.")
+	dnsCache := newPrefetchCache(t, queryMsg, 3)
+	backdate(dnsCache, queryMsg, 95*time.Second)
+	releaseChan := make(chan struct{})
+	item := itemOf(dnsCache, queryMsg)
+	for i := 1; i <= 3; i++ {
+		dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), blockingUpdate(releaseChan))
+		if refreshing := atomic.LoadInt32(&item.refreshing) == 1; refreshing != (i == 3) {
+			t.Fatalf("got prefetching %v after %d hits, want prefetch from 3 hits", refreshing, i)
+		}
+	}
+	close(releaseChan)
+	waitRefreshed(t, dnsCache, 90)
+}
+
+func TestPrefetchDuringReads(t *testing.T) {
+	dnsCache := &Cache{
+		MaxTTL:                   60,
+		MinTTL:                   1,
+		Prefetch:                 true,
+		PrefetchMinHits:          1,
+		PrefetchThresholdPercent: 100,
+	}
+	queryMsg := newTestQuery("prefetch.example.")
+	updateFunc := answerUpdate(1)
+	waitGroup := sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		waitGroup.Add(1)
+		go func(worker int) {
+			defer waitGroup.Done()
+			for i := 0; i < 200; i++ {
+				msg, _, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), updateFunc)
+				if err != nil || len(msg.Answers) != 1 {
+					t.Errorf("got message %v (%v), want one answer", msg, err)
+					return
+				}
+				if worker == 0 {
+					dnsCache.Entries()
+				}
+			}
+		}(worker)
+	}
+	waitGroup.Wait()
+}
+
+func backdate(dnsCache *Cache, queryMsg *dnsmessage.Message, duration time.Duration) {
+	item := itemOf(dnsCache, queryMsg)
+	data := *item.data.Load()
+	data.UpdateAt -= duration.Nanoseconds()
+	item.data.Store(&data)
+}
+
+func waitRefreshed(t *testing.T, dnsCache *Cache, minTTL int) *EntryInfo {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if entries := dnsCache.Entries(); len(entries) == 1 && !entries[0].Stale && entries[0].TTL >= minTTL {
+			return entries[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("entry was not refreshed")
+	return nil
+}
+
+func newStaleCache(t *testing.T, queryMsg *dnsmessage.Message) *Cache {
+	dnsCache := &Cache{
+		MaxTTL:               3600,
+		ServeStale:           true,
+		StaleTTL:             60,
+		StaleAnswerTTL:       30,
+		StaleClientTimeoutMs: 20,
+	}
+	if _, _, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), answerUpdate(10)); err != nil {
+		t.Fatal(err)
+	}
+	backdate(dnsCache, queryMsg, 20*time.Second)
+	return dnsCache
+}
+
+func TestServeStaleWhenUpstreamFails(t *testing.T) {
+	queryMsg := newTestQuery("stale.example.")
+	dnsCache := newStaleCache(t, queryMsg)
+	msg, status, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), failingUpdate)
+	if err != nil || status != StatusStale {
+		t.Fatalf("got status %q (%v), want stale", status, err)
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != 30 {
+		t.Fatalf("got stale answer ttl %d, want 30", ttl)
+	}
+	if dnsCache.StaleHits() != 1 {
+		t.Fatalf("got %d stale hits, want 1", dnsCache.StaleHits())
+	}
+	msg, _, _ = dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), failingUpdate)
+	if ttl := msg.Answers[0].Header.TTL; ttl != 30 {
+		t.Fatalf("got stale answer ttl %d on second stale hit, want 30", ttl)
+	}
+	if entries := dnsCache.Entries(); len(entries) != 1 || !entries[0].Stale {
+		t.Fatalf("got entries %v, want one stale entry", entries)
+	}
+}
+
+func TestServeStaleReturnsFastRefresh(t *testing.T) {
+	queryMsg := newTestQuery("stale.example.")
+	dnsCache := newStaleCache(t, queryMsg)
+	msg, status, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), answerUpdate(10))
+	if err != nil || status != StatusMiss {
+		t.Fatalf("got status %q (%v), want miss", status, err)
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != 10 {
+		t.Fatalf("got refreshed answer ttl %d, want 10", ttl)
+	}
+	if _, status, _ := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), failingUpdate); status != StatusHit {
+		t.Fatalf("got status %q after refresh, want hit", status)
+	}
+}
+
+func TestServeStaleAfterClientTimeout(t *testing.T) {
+	queryMsg := newTestQuery("stale.example.")
+	dnsCache := newStaleCache(t, queryMsg)
+	releaseChan := make(chan struct{})
+	_, status, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), blockingUpdate(releaseChan))
+	if err != nil || status != StatusStale {
+		t.Fatalf("got status %q (%v), want stale", status, err)
+	}
+	close(releaseChan)
+	waitRefreshed(t, dnsCache, 90)
+}
+
+func TestServeStaleWindowExpired(t *testing.T) {
+	queryMsg := newTestQuery("stale.example.")
+	dnsCache := newStaleCache(t, queryMsg)
+	backdate(dnsCache, queryMsg, 60*time.Second)
+	if _, status, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), failingUpdate); err != errTestUpstream || status != StatusMiss {
+		t.Fatalf("got status %q (%v), want miss with upstream error", status, err)
+	}
+}
+
+func TestServeStaleDuringRefresh(t *testing.T) {
+	queryMsg := newTestQuery("stale.example.")
+	dnsCache := newStaleCache(t, queryMsg)
+	refreshes := uint32(0)
+	updateFunc := func(msg *dnsmessage.Message, upstream *network.SocketAddr) (*dnsmessage.Message, error) {
+		count := atomic.AddUint32(&refreshes, 1)
+		if count%2 == 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+		return newTestAnswer(msg, 0, byte(count)), nil
+	}
+	snapshotPath := filepath.Join(t.TempDir(), "cache.snapshot")
+	staleServed := uint32(0)
+	waitGroup := sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		waitGroup.Add(1)
+		go func(worker int) {
+			defer waitGroup.Done()
+			for i := 0; i < 200; i++ {
+				msg, status, err := dnsCache.QueryAndUpdate(queryMsg, "default", newTestUpstream(t), updateFunc)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if status == StatusStale {
+					atomic.AddUint32(&staleServed, 1)
+					if ttl := msg.Answers[0].Header.TTL; ttl != 30 {
+						t.Errorf("got stale ttl %d, want 30", ttl)
+					}
+				}
+				if worker == 0 && i%20 == 0 {
+					dnsCache.Entries()
+					if _, err := dnsCache.SaveSnapshot(snapshotPath); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(worker)
+	}
+	waitGroup.Wait()
+	if atomic.LoadUint32(&staleServed) == 0 {
+		t.Fatal("no stale answers served")
+	}
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func (group *FlightGroup) Do(key string, fn func() (*dnsmessage.Message, error)) (*dnsmessage.Message, error) {
+	group.mutex.Lock()
+	if group.calls == nil {
+		group.calls = make(map[string]*flightCall)
+	}
+	if call, ok := group.calls[key]; ok {
+		call.waiters++
+		group.mutex.Unlock()
+		if common.NeedDebug() {
+			logger.Debug("Join In-Flight Request", key)
+		}
+		call.waitGroup.Wait()
+		return call.msg, call.err
+	}
+	call := &flightCall{}
+	call.waitGroup.Add(1)
+	group.calls[key] = call
+	group.mutex.Unlock()
+
+	call.msg, call.err = fn()
+	call.waitGroup.Done()
+
+	group.mutex.Lock()
+	delete(group.calls, key)
+	waiters := call.waiters
+	group.mutex.Unlock()
+	if waiters > 0 && common.NeedDebug() {
+		logger.Debug("Finish In-Flight Request", key, "shared with", waiters, "waiters")
+	}
+	return call.msg, call.err
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func (dnsCache *Cache) Entries() []*EntryInfo {
+	entries := make([]*EntryInfo, 0)
+	now := time.Now().UnixNano()
+	dnsCache.rangeItems(func(item *Item) bool {
+		data := item.data.Load()
+		if data == nil {
+			return true
+		}
+		remaining := data.ExpireAt() - now
+		if remaining <= -dnsCache.staleWindow() {
+			return true
+		}
+		entry := &EntryInfo{
+			Name:  item.Question.Name.String(),
+			Class: item.Question.Class.String(),
+			Type:  item.Question.Type.String(),
+			Route: item.Route,
+			Hits:  atomic.LoadInt64(&item.Hits),
+		}
+		if remaining > 0 {
+			entry.TTL = int(remaining / time.Second.Nanoseconds())
+		} else {
+			entry.Stale = true
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func (dnsCache *Cache) Purge(name string, qType dnsmessage.Type) int {
+	name = NormalizeName(name)
+	return dnsCache.purgeIf(func(item *Item) bool {
+		return NormalizeName(item.Question.Name.String()) == name && (qType == dnsmessage.Type(0) || item.Question.Type == qType)
+	})
+}
+
+func (dnsCache *Cache) PurgeSuffix(suffix string) int {
+	suffix = NormalizeName(suffix)
+	return dnsCache.purgeIf(func(item *Item) bool {
+		itemName := NormalizeName(item.Question.Name.String())
+		return suffix == "." || itemName == suffix || strings.HasSuffix(itemName, "."+suffix)
+	})
+}
+
+func (dnsCache *Cache) Flush() int {
+	return dnsCache.purgeIf(func(item *Item) bool {
+		return true
+	})
+}
+
+func (dnsCache *Cache) purgeIf(match func(*Item) bool) int {
+	count := 0
+	dnsCache.rangeItems(func(item *Item) bool {
+		if match(item) && dnsCache.deleteItem(item) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+func NormalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func (dnsCache *Cache) Hits() uint64 {
+	return atomic.LoadUint64(&dnsCache.hits)
+}
+
+func (dnsCache *Cache) StaleHits() uint64 {
+	return atomic.LoadUint64(&dnsCache.staleHits)
+}
+
+func (dnsCache *Cache) Misses() uint64 {
+	return atomic.LoadUint64(&dnsCache.misses)
+}
+
+func (dnsCache *Cache) Evictions() uint64 {
+	dnsCache.shardsOnce.Do(dnsCache.initShards)
+	evictions := uint64(0)
+	for _, s := range dnsCache.shards {
+		s.mutex.RLock()
+		evictions += s.evictions
+		s.mutex.RUnlock()
+	}
+	return evictions
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotMagic = "ACCDNSC"
+const snapshotVersion = 3
+
+func (dnsCache *Cache) SaveSnapshot(filePath string) (int, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	writer := bufio.NewWriter(tmpFile)
+	if _, err := writer.WriteString(snapshotMagic); err != nil {
+		_ = tmpFile.Close()
+		return 0, err
+	}
+	if err := writer.WriteByte(snapshotVersion); err != nil {
+		_ = tmpFile.Close()
+		return 0, err
+	}
+	count := 0
+	var saveErr error
+	now := time.Now().UnixNano()
+	dnsCache.rangeItems(func(item *Item) bool {
+		data := item.data.Load()
+		if data == nil || data.ExpireAt()+dnsCache.staleWindow() <= now {
+			return true
+		}
+		msgBytes, err := packCopy(data.Msg)
+		if err != nil {
+			logger.Warning("Pack Cache Snapshot Entry", item.key.String(), err)
+			return true
+		}
+		keyBytes := encodeItemKey(&item.key)
+		record := bytes.NewBuffer([]byte{})
+		_ = binary.Write(record, binary.BigEndian, uint16(len(keyBytes)))
+		record.Write(keyBytes)
+		_ = binary.Write(record, binary.BigEndian, data.ExpireAt())
+		_ = binary.Write(record, binary.BigEndian, uint32(data.TTL))
+		_ = binary.Write(record, binary.BigEndian, uint32(len(msgBytes)))
+		record.Write(msgBytes)
+		_ = binary.Write(record, binary.BigEndian, crc32.ChecksumIEEE(record.Bytes()))
+		if _, saveErr = writer.Write(record.Bytes()); saveErr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if saveErr != nil {
+		_ = tmpFile.Close()
+		return 0, saveErr
+	}
+	if err := writer.Flush(); err != nil {
+		_ = tmpFile.Close()
+		return 0, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func packCopy(msg *dnsmessage.Message) ([]byte, error) {
+	msgCopy := *msg
+	msgCopy.Answers = append([]dnsmessage.Resource(nil), msg.Answers...)
+	msgCopy.Authorities = append([]dnsmessage.Resource(nil), msg.Authorities...)
+	msgCopy.Additionals = append([]dnsmessage.Resource(nil), msg.Additionals...)
+	return msgCopy.Pack()
+}
+
+func (dnsCache *Cache) LoadSnapshot(filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, errors.New("cache snapshot header is broken")
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errors.New("file is not a cache snapshot")
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return 0, errors.New("cache snapshot version is not supported")
+	}
+	count := 0
+	now := time.Now().UnixNano()
+	for {
+		item, err := readSnapshotRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warning("Load Cache Snapshot", "stop at broken record", err)
+			break
+		}
+		if item.data.Load().ExpireAt()+dnsCache.staleWindow() <= now {
+			continue
+		}
+		dnsCache.storeItem(item)
+		count++
+	}
+	return count, nil
+}
+
+func readSnapshotRecord(reader *bufio.Reader) (*Item, error) {
+	record := bytes.NewBuffer([]byte{})
+	teeReader := io.TeeReader(reader, record)
+	keyLen := uint16(0)
+	if err := binary.Read(teeReader, binary.BigEndian, &keyLen); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.New("record header is truncated")
+	}
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(teeReader, keyBytes); err != nil {
+		return nil, errors.New("record key is truncated")
+	}
+	expireAt := int64(0)
+	ttl := uint32(0)
+	msgLen := uint32(0)
+	if err := binary.Read(teeReader, binary.BigEndian, &expireAt); err != nil {
+		return nil, errors.New("record is truncated")
+	}
+	if err := binary.Read(teeReader, binary.BigEndian, &ttl); err != nil {
+		return nil, errors.New("record is truncated")
+	}
+	if err := binary.Read(teeReader, binary.BigEndian, &msgLen); err != nil {
+		return nil, errors.New("record is truncated")
+	}
+	if msgLen > 65535 {
+		return nil, errors.New("record message is too large")
+	}
+	msgBytes := make([]byte, msgLen)
+	if _, err := io.ReadFull(teeReader, msgBytes); err != nil {
+		return nil, errors.New("record message is truncated")
+	}
+	checksum := crc32.ChecksumIEEE(record.Bytes())
+	savedChecksum := uint32(0)
+	if err := binary.Read(reader, binary.BigEndian, &savedChecksum); err != nil {
+		return nil, errors.New("record checksum is truncated")
+	}
+	if checksum != savedChecksum {
+		return nil, errors.New("record checksum is not match")
+	}
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(msgBytes); err != nil {
+		return nil, err
+	}
+	key, ok := decodeItemKey(keyBytes)
+	if !ok {
+		return nil, errors.New("record key is broken")
+	}
+	if len(msg.Questions) < 1 {
+		return nil, errors.New("record message has no question")
+	}
+	item := &Item{
+		Question: msg.Questions[0],
+		Route:    key.route,
+		key:      key,
+	}
+	item.data.Store(&itemData{
+		Msg:      msg,
+		TTL:      int(ttl),
+		UpdateAt: expireAt - (time.Duration(ttl) * time.Second).Nanoseconds(),
+	})
+	return item, nil
+}
+
+func (dnsCache *Cache) StartSnapshotLoop(filePath string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			count, err := dnsCache.SaveSnapshot(filePath)
+			if err != nil {
+				logger.Warning("Save Cache Snapshot", filePath, err)
+				continue
+			}
+			if common.NeedDebug() {
+				logger.Debug("Save Cache Snapshot", "saved", count, "entries to", filePath)
+			}
+		}
+	}()
+}
+
+func (dnsCache *Cache) staleWindow() int64 {
+	if !dnsCache.ServeStale {
+		return 0
+	}
+	return (time.Duration(dnsCache.StaleTTL) * time.Second).Nanoseconds()
+}
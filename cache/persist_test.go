@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dnsCache := &Cache{MaxTTL: 3600}
+	queries := []*dnsmessage.Message{newTestQuery("a.example."), newTestQuery("b.example.")}
+	for _, queryMsg := range queries {
+		for _, route := range []string{"default", "overseas"} {
+			if _, _, err := dnsCache.QueryAndUpdate(queryMsg, route, upstream, answerUpdate(300)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	snapshotPath := filepath.Join(t.TempDir(), "cache.snapshot")
+	if count, err := dnsCache.SaveSnapshot(snapshotPath); err != nil || count != 4 {
+		t.Fatalf("saved %d entries (%v), want 4", count, err)
+	}
+	loadedCache := &Cache{MaxTTL: 3600}
+	if count, err := loadedCache.LoadSnapshot(snapshotPath); err != nil || count != 4 {
+		t.Fatalf("loaded %d entries (%v), want 4", count, err)
+	}
+	msg, status, err := loadedCache.QueryAndUpdate(queries[1], "overseas", upstream, failingUpdate)
+	if err != nil || status != StatusHit {
+		t.Fatalf("got status %q (%v), want hit", status, err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 300 {
+		t.Fatalf("got answers %v, want one record with ttl 300", msg.Answers)
+	}
+}
+
+func TestSnapshotStopsAtBrokenRecord(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dnsCache := &Cache{MaxTTL: 3600}
+	for _, name := range []string{"a.example.", "b.example."} {
+		if _, _, err := dnsCache.QueryAndUpdate(newTestQuery(name), "default", upstream, answerUpdate(300)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotPath := filepath.Join(t.TempDir(), "cache.snapshot")
+	if _, err := dnsCache.SaveSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	snapshotBytes, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotBytes[len(snapshotBytes)-1] ^= 0xFF
+	if err := os.WriteFile(snapshotPath, snapshotBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadedCache := &Cache{MaxTTL: 3600}
+	if count, err := loadedCache.LoadSnapshot(snapshotPath); err != nil || count != 1 {
+		t.Fatalf("loaded %d entries (%v), want 1", count, err)
+	}
+}
+
+func TestSaveSnapshotKeepsCachedMessage(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dnsCache := &Cache{MaxTTL: 3600}
+	queryMsg := newTestQuery("a.example.")
+	cachedMsg, _, err := dnsCache.QueryAndUpdate(queryMsg, "default", upstream, answerUpdate(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dnsCache.SaveSnapshot(filepath.Join(t.TempDir(), "cache.snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if length := cachedMsg.Answers[0].Header.Length; length != 0 {
+		t.Fatalf("snapshot rewrote the cached record length to %d", length)
+	}
+}
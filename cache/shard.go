@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"accdns/common"
+	"encoding/hex"
+	"golang.org/x/net/dns/dnsmessage"
+	"sync/atomic"
+)
+
+const (
+	keyFlagCheckingDisabled = 1 << iota
+	keyFlagDNSSECOK
+)
+
+const fnvOffsetBasis = 2166136261
+const fnvPrime = 16777619
+
+func makeItemKey(queryMsg *dnsmessage.Message, route string) (key itemKey, hash uint32) {
+	question := &queryMsg.Questions[0]
+	key.nameLen = question.Name.Length
+	for i := 0; i < int(question.Name.Length); i++ {
+		c := question.Name.Data[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		key.name[i] = c
+	}
+	key.class = question.Class
+	key.qType = question.Type
+	key.route = route
+	if queryMsg.Header.CheckingDisabled {
+		key.flags |= keyFlagCheckingDisabled
+	}
+	for i := range queryMsg.Additionals {
+		res := &queryMsg.Additionals[i]
+		if res.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		if res.Header.DNSSECAllowed() {
+			key.flags |= keyFlagDNSSECOK
+		}
+		if optRes, ok := res.Body.(*dnsmessage.OPTResource); ok {
+			for j := range optRes.Options {
+				if optRes.Options[j].Code == common.EDNSOptionCodeClientSubnet {
+					key.setECSScope(optRes.Options[j].Data)
+				}
+			}
+		}
+	}
+	return key, key.hash()
+}
+
+func (key *itemKey) setECSScope(data []byte) {
+	scopeLen := len(data)
+	if len(data) >= 4 {
+		scopeLen = 4 + (int(data[2])+7)/8
+		if scopeLen > len(data) {
+			scopeLen = len(data)
+		}
+	}
+	if scopeLen > len(key.ecs) {
+		scopeLen = len(key.ecs)
+	}
+	key.ecsLen = uint8(copy(key.ecs[:scopeLen], data))
+	if key.ecsLen >= 4 {
+		key.ecs[3] = 0
+	}
+}
+
+func (key *itemKey) String() string {
+	flags := ""
+	if key.flags&keyFlagCheckingDisabled != 0 {
+		flags += "CD"
+	}
+	if key.flags&keyFlagDNSSECOK != 0 {
+		flags += "DO"
+	}
+	return string(key.name[:key.nameLen]) + "|" + key.class.String() + "|" + key.qType.String() + "|" + key.route + "|" + flags + "|" + hex.EncodeToString(key.ecs[:key.ecsLen])
+}
+
+func (key *itemKey) hash() uint32 {
+	hash := uint32(fnvOffsetBasis)
+	for i := 0; i < int(key.nameLen); i++ {
+		hash = (hash ^ uint32(key.name[i])) * fnvPrime
+	}
+	hash = (hash ^ uint32(key.qType)) * fnvPrime
+	hash = (hash ^ uint32(key.class)) * fnvPrime
+	hash = (hash ^ uint32(key.flags)) * fnvPrime
+	for i := 0; i < len(key.route); i++ {
+		hash = (hash ^ uint32(key.route[i])) * fnvPrime
+	}
+	for i := 0; i < int(key.ecsLen); i++ {
+		hash = (hash ^ uint32(key.ecs[i])) * fnvPrime
+	}
+	return hash
+}
+
+func (dnsCache *Cache) initShards() {
+	shardCount := dnsCache.Shards
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	capacity := 0
+	if dnsCache.MaxEntries > 0 {
+		capacity = (dnsCache.MaxEntries + shardCount - 1) / shardCount
+	}
+	dnsCache.shards = make([]*shard, shardCount)
+	for i := range dnsCache.shards {
+		dnsCache.shards[i] = &shard{
+			items:    make(map[itemKey]*Item),
+			capacity: capacity,
+		}
+	}
+}
+
+func (dnsCache *Cache) shardOf(hash uint32) *shard {
+	dnsCache.shardsOnce.Do(dnsCache.initShards)
+	return dnsCache.shards[hash%uint32(len(dnsCache.shards))]
+}
+
+func (dnsCache *Cache) rangeItems(f func(*Item) bool) {
+	dnsCache.shardsOnce.Do(dnsCache.initShards)
+	for _, s := range dnsCache.shards {
+		s.mutex.RLock()
+		items := make([]*Item, 0, len(s.items))
+		for _, item := range s.items {
+			items = append(items, item)
+		}
+		s.mutex.RUnlock()
+		for _, item := range items {
+			if !f(item) {
+				return
+			}
+		}
+	}
+}
+
+func (dnsCache *Cache) storeItem(item *Item) {
+	dnsCache.shardOf(item.key.hash()).store(item)
+}
+
+func (dnsCache *Cache) deleteItem(item *Item) bool {
+	return dnsCache.shardOf(item.key.hash()).delete(item)
+}
+
+func (dnsCache *Cache) Len() int {
+	dnsCache.shardsOnce.Do(dnsCache.initShards)
+	count := 0
+	for _, s := range dnsCache.shards {
+		s.mutex.RLock()
+		count += len(s.items)
+		s.mutex.RUnlock()
+	}
+	return count
+}
+
+func (s *shard) load(key *itemKey) *Item {
+	s.mutex.RLock()
+	item, ok := s.items[*key]
+	promote := ok && s.capacity > 0 && s.sequence-item.sequence >= uint64(s.capacity/2)
+	s.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	if promote {
+		s.mutex.Lock()
+		if s.items[*key] == item {
+			s.moveToFront(item)
+		}
+		s.mutex.Unlock()
+	}
+	return item
+}
+
+func (s *shard) storeData(key *itemKey, question *dnsmessage.Question, data *itemData) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if item, ok := s.items[*key]; ok {
+		item.data.Store(data)
+		atomic.StoreInt64(&item.Hits, 0)
+		s.moveToFront(item)
+		return
+	}
+	item := &Item{
+		Question: *question,
+		Route:    key.route,
+		key:      *key,
+	}
+	item.data.Store(data)
+	s.insert(item)
+}
+
+func (s *shard) store(item *Item) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if oldItem, ok := s.items[item.key]; ok {
+		s.unlink(oldItem)
+	}
+	s.insert(item)
+}
+
+func (s *shard) delete(item *Item) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.items[item.key] != item {
+		return false
+	}
+	s.unlink(item)
+	delete(s.items, item.key)
+	return true
+}
+
+func (s *shard) insert(item *Item) {
+	s.items[item.key] = item
+	s.sequence++
+	item.sequence = s.sequence
+	item.prev = nil
+	item.next = s.head
+	if s.head != nil {
+		s.head.prev = item
+	}
+	s.head = item
+	if s.tail == nil {
+		s.tail = item
+	}
+	for s.capacity > 0 && len(s.items) > s.capacity && s.tail != nil {
+		evictedItem := s.tail
+		s.unlink(evictedItem)
+		delete(s.items, evictedItem.key)
+		s.evictions++
+	}
+}
+
+func (s *shard) moveToFront(item *Item) {
+	s.sequence++
+	item.sequence = s.sequence
+	if s.head == item {
+		return
+	}
+	s.unlink(item)
+	item.next = s.head
+	if s.head != nil {
+		s.head.prev = item
+	}
+	s.head = item
+	if s.tail == nil {
+		s.tail = item
+	}
+}
+
+func (s *shard) unlink(item *Item) {
+	if item.prev != nil {
+		item.prev.next = item.next
+	} else if s.head == item {
+		s.head = item.next
+	}
+	if item.next != nil {
+		item.next.prev = item.prev
+	} else if s.tail == item {
+		s.tail = item.prev
+	}
+	item.prev = nil
+	item.next = nil
+}
+
+func encodeItemKey(key *itemKey) []byte {
+	keyBytes := make([]byte, 0, 8+int(key.nameLen)+int(key.ecsLen)+len(key.route))
+	keyBytes = append(keyBytes, key.nameLen)
+	keyBytes = append(keyBytes, key.name[:key.nameLen]...)
+	keyBytes = append(keyBytes, byte(key.class>>8), byte(key.class), byte(key.qType>>8), byte(key.qType), key.flags, key.ecsLen)
+	keyBytes = append(keyBytes, key.ecs[:key.ecsLen]...)
+	keyBytes = append(keyBytes, key.route...)
+	return keyBytes
+}
+
+func decodeItemKey(keyBytes []byte) (key itemKey, ok bool) {
+	if len(keyBytes) < 1 || len(keyBytes) < 7+int(keyBytes[0]) {
+		return
+	}
+	key.nameLen = keyBytes[0]
+	copy(key.name[:], keyBytes[1:1+int(key.nameLen)])
+	keyBytes = keyBytes[1+int(key.nameLen):]
+	key.class = dnsmessage.Class(uint16(keyBytes[0])<<8 | uint16(keyBytes[1]))
+	key.qType = dnsmessage.Type(uint16(keyBytes[2])<<8 | uint16(keyBytes[3]))
+	key.flags = keyBytes[4]
+	key.ecsLen = keyBytes[5]
+	keyBytes = keyBytes[6:]
+	if int(key.ecsLen) > len(key.ecs) || int(key.ecsLen) > len(keyBytes) {
+		return
+	}
+	copy(key.ecs[:], keyBytes[:key.ecsLen])
+	key.route = string(keyBytes[key.ecsLen:])
+	return key, true
+}
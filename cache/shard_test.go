@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"accdns/network"
+	"golang.org/x/net/dns/dnsmessage"
+	"strconv"
+	"testing"
+)
+
+func fillCache(t *testing.T, dnsCache *Cache, names ...string) {
+	upstream := newTestUpstream(t)
+	for _, name := range names {
+		if _, _, err := dnsCache.QueryAndUpdate(newTestQuery(name), "default", upstream, answerUpdate(300)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShardEvictsLeastRecentlyUsed(t *testing.T) {
+	dnsCache := &Cache{Shards: 1, MaxTTL: 3600, MaxEntries: 4}
+	fillCache(t, dnsCache, "a.example.", "b.example.", "c.example.", "d.example.")
+	if _, status, err := dnsCache.QueryAndUpdate(newTestQuery("a.example."), "default", newTestUpstream(t), failingUpdate); err != nil || status != StatusHit {
+		t.Fatalf("got status %q (%v), want hit", status, err)
+	}
+	fillCache(t, dnsCache, "e.example.")
+	if itemOf(dnsCache, newTestQuery("b.example.")) != nil {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if itemOf(dnsCache, newTestQuery("a.example.")) == nil {
+		t.Fatal("recently hit entry was evicted")
+	}
+	if dnsCache.Len() != 4 || dnsCache.Evictions() != 1 {
+		t.Fatalf("got %d entries and %d evictions, want 4 and 1", dnsCache.Len(), dnsCache.Evictions())
+	}
+}
+
+func TestShardPromotesOnlyOlderHits(t *testing.T) {
+	dnsCache := &Cache{Shards: 1, MaxTTL: 3600, MaxEntries: 4}
+	fillCache(t, dnsCache, "a.example.", "b.example.", "c.example.", "d.example.")
+	s := dnsCache.shardOf(0)
+	upstream := newTestUpstream(t)
+	for _, name := range []string{"d.example.", "c.example."} {
+		if _, _, err := dnsCache.QueryAndUpdate(newTestQuery(name), "default", upstream, failingUpdate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.sequence != 4 || s.head.Question.Name.String() != "d.example." {
+		t.Fatalf("hits on recent entries reordered the shard (sequence %d)", s.sequence)
+	}
+	if _, _, err := dnsCache.QueryAndUpdate(newTestQuery("b.example."), "default", upstream, failingUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if s.sequence != 5 || s.head.Question.Name.String() != "b.example." {
+		t.Fatalf("hit on an older entry was not promoted (sequence %d)", s.sequence)
+	}
+}
+
+func TestShardCapacityIsSplitAcrossShards(t *testing.T) {
+	dnsCache := &Cache{Shards: 4, MaxTTL: 3600, MaxEntries: 10}
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = "host" + strconv.Itoa(i) + ".example."
+	}
+	fillCache(t, dnsCache, names...)
+	for i, s := range dnsCache.shards {
+		if len(s.items) > 3 {
+			t.Fatalf("shard %d holds %d entries, want at most 3", i, len(s.items))
+		}
+	}
+	if count := dnsCache.Len(); count < 10 || count > 12 || dnsCache.Evictions() != uint64(100-count) {
+		t.Fatalf("got %d entries and %d evictions", count, dnsCache.Evictions())
+	}
+}
+
+func TestShardKeyIgnoresNameCase(t *testing.T) {
+	dnsCache := &Cache{Shards: 8, MaxTTL: 3600}
+	fillCache(t, dnsCache, "Mixed.Example.")
+	upstream := newTestUpstream(t)
+	if _, status, err := dnsCache.QueryAndUpdate(newTestQuery("mixed.example."), "default", upstream, failingUpdate); err != nil || status != StatusHit {
+		t.Fatalf("got status %q (%v), want hit", status, err)
+	}
+	queryMsg := newTestQuery("mixed.example.")
+	queryMsg.Header.CheckingDisabled = true
+	if _, status, _ := dnsCache.QueryAndUpdate(queryMsg, "default", upstream, failingUpdate); status == StatusHit {
+		t.Fatal("checking disabled query shared the cached entry")
+	}
+	if _, status, _ := dnsCache.QueryAndUpdate(newTestQuery("mixed.example."), "overseas", upstream, failingUpdate); status == StatusHit {
+		t.Fatal("query on another route shared the cached entry")
+	}
+	entries := dnsCache.Entries()
+	if len(entries) != 1 || entries[0].Hits != 1 {
+		t.Fatalf("got entries %v, want one entry with one hit", entries)
+	}
+}
+
+func TestUncachedResponsesDoNotTakeEntries(t *testing.T) {
+	dnsCache := &Cache{MaxTTL: 60, MaxEntries: 1}
+	upstream := newTestUpstream(t)
+	cachedMsg := newTestQuery("cached.example.")
+	nxDomainFunc := func(msg *dnsmessage.Message, upstream *network.SocketAddr) (*dnsmessage.Message, error) {
+		return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}, Questions: msg.Questions}, nil
+	}
+	if _, _, err := dnsCache.QueryAndUpdate(cachedMsg, "default", upstream, answerUpdate(60)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := dnsCache.QueryAndUpdate(newTestQuery("missing"+strconv.Itoa(i)+".example."), "default", upstream, nxDomainFunc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dnsCache.Len() != 1 {
+		t.Fatalf("got %d entries, want 1", dnsCache.Len())
+	}
+	if _, status, err := dnsCache.QueryAndUpdate(cachedMsg, "default", upstream, failingUpdate); err != nil || status != StatusHit {
+		t.Fatalf("got status %q err %v, want hit", status, err)
+	}
+}
@@ -3,15 +3,84 @@ package cache
 import (
 	"golang.org/x/net/dns/dnsmessage"
 	"sync"
+	"sync/atomic"
 )
 
 type Cache struct {
-	cacheMap sync.Map
-	MaxTTL   int
-	MinTTL   int
+	hits                     uint64
+	staleHits                uint64
+	misses                   uint64
+	shards                   []*shard
+	shardsOnce               sync.Once
+	flights                  FlightGroup
+	Shards                   int
+	MaxEntries               int
+	MaxTTL                   int
+	MinTTL                   int
+	ServeStale               bool
+	StaleTTL                 int
+	StaleAnswerTTL           int
+	StaleClientTimeoutMs     int
+	Prefetch                 bool
+	PrefetchMinHits          int
+	PrefetchThresholdPercent int
 }
 type Item struct {
-	UpdateAt int64
-	TTL      int
+	Question   dnsmessage.Question
+	Route      string
+	Hits       int64
+	refreshing int32
+	data       atomic.Pointer[itemData]
+	key        itemKey
+	sequence   uint64
+	prev       *Item
+	next       *Item
+}
+
+type itemData struct {
 	Msg      *dnsmessage.Message
+	TTL      int
+	UpdateAt int64
+}
+
+type itemKey struct {
+	name    [255]byte
+	nameLen uint8
+	class   dnsmessage.Class
+	qType   dnsmessage.Type
+	flags   uint8
+	ecsLen  uint8
+	ecs     [20]byte
+	route   string
+}
+
+type shard struct {
+	mutex     sync.RWMutex
+	items     map[itemKey]*Item
+	head      *Item
+	tail      *Item
+	capacity  int
+	sequence  uint64
+	evictions uint64
+}
+
+type EntryInfo struct {
+	Name  string `json:"name"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	Route string `json:"route"`
+	TTL   int    `json:"ttl"`
+	Stale bool   `json:"stale"`
+	Hits  int64  `json:"hits"`
+}
+
+type FlightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+type flightCall struct {
+	waitGroup sync.WaitGroup
+	msg       *dnsmessage.Message
+	err       error
+	waiters   int
 }
@@ -2,60 +2,166 @@ package common
 
 import (
 	"errors"
+	"golang.org/x/net/dns/dnsmessage"
 	"gopkg.in/ini.v1"
+	"strconv"
 	"strings"
 )
 
 const StandardMaxDNSPacketSize = 512
+const EDNSOptionCodeClientSubnet = 8
 
-var Config = &ConfigStruct{
-	Service: &ServiceConfig{
-		ListenAddr: "[::]:53",
-		ListenUDP:  true,
-		ListenTCP:  false,
-	},
-	Upstream: &UpstreamConfig{
-		DefaultUpstreams:     make([]string, 0),
-		ARecordUpstreams:     make([]string, 0),
-		AAAARecordUpstreams:  make([]string, 0),
-		CNAMERecordUpstreams: make([]string, 0),
-		TXTRecordUpstreams:   make([]string, 0),
-		PTRRecordUpstreams:   make([]string, 0),
-		CustomRecordUpstream: make([]string, 0),
-	},
-	Cache: &CacheConfig{
-		EnableCache: true,
-		MaxTTL:      3600,
-		MinTTL:      10,
-	},
-	Log: &LogConfig{
-		LogFilePath:        "accdns.log",
-		LogFileMaxSizeKB:   16 * 1024,
-		LogLevelForFile:    "info",
-		LogLevelForConsole: "info",
-	},
-	Advanced: &AdvancedConfig{
-		NSLookupTimeoutMs:     20000,
-		RWTimeoutMs:           8000,
-		MaxReceivedPacketSize: 4096,
-		ConnectionTimeout:     60,
-		NetworkFailedRetries:  3,
-	},
+var Config = defaultConfig()
+
+func defaultConfig() *ConfigStruct {
+	return &ConfigStruct{
+		Service: &ServiceConfig{
+			ListenAddr:         "[::]:53",
+			ListenUDP:          true,
+			ListenTCP:          false,
+			ShutdownTimeoutSec: 5,
+		},
+		Upstream: &UpstreamConfig{
+			DefaultUpstreams:     make([]string, 0),
+			ARecordUpstreams:     make([]string, 0),
+			AAAARecordUpstreams:  make([]string, 0),
+			CNAMERecordUpstreams: make([]string, 0),
+			TXTRecordUpstreams:   make([]string, 0),
+			PTRRecordUpstreams:   make([]string, 0),
+			CustomRecordUpstream: make([]string, 0),
+			GroupUpstreams:       make([]string, 0),
+			GroupIPBlacklist:     make([]string, 0),
+			GroupIPAllowlist:     make([]string, 0),
+			GroupFallback:        make([]string, 0),
+		},
+		GeoIP: &GeoIPConfig{
+			EnableGeoIP:           false,
+			DomesticGroup:         "domestic",
+			OverseasGroup:         "overseas",
+			DomesticCIDRFilePaths: make([]string, 0),
+		},
+		Cache: &CacheConfig{
+			EnableCache:              true,
+			MaxTTL:                   3600,
+			MinTTL:                   10,
+			ServeStale:               false,
+			StaleTTL:                 86400,
+			StaleAnswerTTL:           30,
+			StaleClientTimeoutMs:     1800,
+			Prefetch:                 false,
+			PrefetchMinHits:          10,
+			PrefetchThresholdPercent: 10,
+			SnapshotFilePath:         "",
+			SnapshotIntervalSec:      300,
+			Shards:                   16,
+			MaxEntries:               100000,
+			WarmUpFilePath:           "",
+			WarmUpConcurrency:        16,
+			WarmUpBeforeListen:       false,
+		},
+		Local: &LocalConfig{
+			HostsFilePath: "",
+			Records:       make([]string, 0),
+			TTL:           600,
+			ZoneFilePaths: make([]string, 0),
+		},
+		Filter: &FilterConfig{
+			EnableFilter:      false,
+			ListFilePaths:     make([]string, 0),
+			BlockResponse:     "zero",
+			BlockIPv4:         "",
+			BlockIPv6:         "",
+			BlockTTL:          300,
+			ReloadIntervalSec: 600,
+		},
+		Rebinding: &RebindingConfig{
+			EnableRebindingProtection: false,
+			Action:                    "strip",
+			AllowedSuffixes:           make([]string, 0),
+		},
+		ACL: &ACLConfig{
+			DefaultAction:         "allow",
+			Rules:                 make([]string, 0),
+			Policies:              make([]string, 0),
+			PolicyUpstreamGroup:   make([]string, 0),
+			PolicyFilter:          make([]string, 0),
+			PolicyQueriesPerSec:   make([]string, 0),
+			PolicyResponsesPerSec: make([]string, 0),
+		},
+		RateLimit: &RateLimitConfig{
+			EnableRateLimit: false,
+			QueriesPerSec:   100,
+			ResponsesPerSec: 10,
+			Slip:            2,
+			IPv4PrefixLen:   24,
+			IPv6PrefixLen:   56,
+			MaxBuckets:      65536,
+		},
+		DNSSEC: &DNSSECConfig{
+			EnableValidation:    false,
+			TrustAnchorFilePath: "",
+		},
+		QueryLog: &QueryLogConfig{
+			EnableQueryLog: false,
+			FilePath:       "query.log",
+			MaxSizeKB:      16 * 1024,
+			MaxBackups:     3,
+			BufferSize:     1024,
+		},
+		Dnstap: &DnstapConfig{
+			EnableDnstap: false,
+			SocketPath:   "",
+			FilePath:     "",
+			Identity:     "",
+			BufferSize:   4096,
+		},
+		Stats: &StatsConfig{
+			EnableStats:     true,
+			MaxTrackedNames: 10000,
+			RecentQueries:   1000,
+		},
+		Log: &LogConfig{
+			LogFilePath:        "accdns.log",
+			LogFileMaxSizeKB:   16 * 1024,
+			LogLevelForFile:    "info",
+			LogLevelForConsole: "info",
+		},
+		Admin: &AdminConfig{
+			ListenAddr: "",
+			Token:      "",
+		},
+		Advanced: &AdvancedConfig{
+			NSLookupTimeoutMs:     20000,
+			RWTimeoutMs:           8000,
+			MaxReceivedPacketSize: 4096,
+			ConnectionTimeout:     60,
+			NetworkFailedRetries:  3,
+			RandomizeQueryCase:    false,
+		},
+	}
 }
 
 func Init(configFilePath string) error {
+	config, err := Load(configFilePath)
+	if err != nil {
+		return err
+	}
+	Config = config
+	return nil
+}
 
+func Load(configFilePath string) (*ConfigStruct, error) {
+	config := defaultConfig()
 	if configFilePath != "" {
 		cfg, err := ini.Load(configFilePath)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := cfg.MapTo(Config); err != nil {
-			return err
+		if err := cfg.MapTo(config); err != nil {
+			return nil, err
 		}
 	}
-
-	return nil
+	return config, nil
 }
 func CreateConfigFile(configFilePath string) error {
 	cfg := ini.Empty()
@@ -75,6 +181,41 @@ func ParseKVPair(kvPair string) (key, value string, err error) {
 	return kvPair[:index], kvPair[index+1:], nil
 }
 
+func ParseRecordType(typeStr string) (dnsmessage.Type, error) {
+	typeStr = strings.ToUpper(strings.TrimSpace(typeStr))
+	switch typeStr {
+	case "A":
+		return dnsmessage.TypeA, nil
+	case "NS":
+		return dnsmessage.TypeNS, nil
+	case "CNAME":
+		return dnsmessage.TypeCNAME, nil
+	case "SOA":
+		return dnsmessage.TypeSOA, nil
+	case "PTR":
+		return dnsmessage.TypePTR, nil
+	case "MX":
+		return dnsmessage.TypeMX, nil
+	case "TXT":
+		return dnsmessage.TypeTXT, nil
+	case "AAAA":
+		return dnsmessage.TypeAAAA, nil
+	case "SRV":
+		return dnsmessage.TypeSRV, nil
+	case "SVCB":
+		return dnsmessage.Type(64), nil
+	case "HTTPS":
+		return dnsmessage.Type(65), nil
+	case "ANY":
+		return dnsmessage.TypeALL, nil
+	}
+	typeCode, err := strconv.Atoi(strings.TrimPrefix(typeStr, "TYPE"))
+	if err != nil || typeCode < 0 || typeCode > 65535 {
+		return 0, errors.New("record type \"" + typeStr + "\" is not correct")
+	}
+	return dnsmessage.Type(typeCode), nil
+}
+
 func NeedDebug() bool {
 	return Config.Log.LogLevelForFile == "debug" || Config.Log.LogLevelForConsole == "debug"
 }
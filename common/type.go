@@ -1,17 +1,29 @@
 package common
 
 type ConfigStruct struct {
-	Service  *ServiceConfig
-	Upstream *UpstreamConfig
-	Cache    *CacheConfig
-	Log      *LogConfig
-	Advanced *AdvancedConfig
+	Service   *ServiceConfig
+	Upstream  *UpstreamConfig
+	GeoIP     *GeoIPConfig
+	Cache     *CacheConfig
+	Local     *LocalConfig
+	Filter    *FilterConfig
+	Rebinding *RebindingConfig
+	ACL       *ACLConfig
+	RateLimit *RateLimitConfig
+	DNSSEC    *DNSSECConfig
+	QueryLog  *QueryLogConfig
+	Dnstap    *DnstapConfig
+	Stats     *StatsConfig
+	Log       *LogConfig
+	Admin     *AdminConfig
+	Advanced  *AdvancedConfig
 }
 
 type ServiceConfig struct {
-	ListenAddr string `comment:"Listen Address (Example: [::]:53)"`
-	ListenUDP  bool   `comment:"Listen on UDP Port"`
-	ListenTCP  bool   `comment:"Listen on TCP Port"`
+	ListenAddr         string `comment:"Listen Address (Example: [::]:53)"`
+	ListenUDP          bool   `comment:"Listen on UDP Port"`
+	ListenTCP          bool   `comment:"Listen on TCP Port"`
+	ShutdownTimeoutSec int    `comment:"Max Time to Wait for In-Flight Queries on Shutdown (Seconds)"`
 }
 
 type UpstreamConfig struct {
@@ -22,6 +34,17 @@ type UpstreamConfig struct {
 	TXTRecordUpstreams   []string `comment:"Upstream List for TXT Record (Example: 223.5.5.5,udp:223.6.6.6:53,tcp:208.67.222.222,2001:da8::666,[2620:0:ccd::2]:53,tcp:2620:0:ccc::2)"`
 	PTRRecordUpstreams   []string `comment:"Upstream List for PTR Record (Example: 223.5.5.5,udp:223.6.6.6:53,tcp:208.67.222.222,2001:da8::666,[2620:0:ccd::2]:53,tcp:2620:0:ccc::2)"`
 	CustomRecordUpstream []string `comment:"Upstream List for Custom Record (Example: 1:223.5.5.5,1:udp:223.6.6.6:53,1:tcp:208.67.222.222,28:2001:da8::666,28:[2620:0:ccd::2]:53,28:tcp:2620:0:ccc::2)"`
+	GroupUpstreams       []string `comment:"Upstream List for Named Groups (Example: domestic:223.5.5.5,domestic:tcp:119.29.29.29,overseas:8.8.8.8)"`
+	GroupIPBlacklist     []string `comment:"Discard Responses of a Group Containing These IPs, CIDRs or CIDR List Files (Example: domestic:/etc/accdns/bogus.txt,default:10.10.34.0/24)"`
+	GroupIPAllowlist     []string `comment:"Accept Only Responses of a Group Whose A/AAAA Are in These CIDRs or CIDR List Files (Example: domestic:/etc/accdns/china.txt)"`
+	GroupFallback        []string `comment:"Group to Query When All Responses of a Group Are Discarded (Example: domestic:overseas)"`
+}
+
+type GeoIPConfig struct {
+	EnableGeoIP           bool     `comment:"Query Domestic and Overseas Groups in Parallel for Non-specific Records and Choose by Answer Location"`
+	DomesticGroup         string   `comment:"Upstream Group Trusted for Names Resolving to Domestic Addresses"`
+	OverseasGroup         string   `comment:"Upstream Group Used When the Domestic Answer Is Not Domestic"`
+	DomesticCIDRFilePaths []string `comment:"Domestic CIDR List Files, One CIDR per Line (Example: /etc/accdns/china_ipv4.txt,/etc/accdns/china_ipv6.txt)"`
 }
 
 type LogConfig struct {
@@ -31,16 +54,106 @@ type LogConfig struct {
 	LogLevelForConsole string `comment:"Log Level for Console"`
 }
 
+type QueryLogConfig struct {
+	EnableQueryLog bool   `comment:"Write One JSON Line per Client Query"`
+	FilePath       string `comment:"Query Log File Path"`
+	MaxSizeKB      int64  `comment:"Rotate Query Log When It Exceeds This Size (KB)"`
+	MaxBackups     int    `comment:"Number of Rotated Query Logs to Keep"`
+	BufferSize     int    `comment:"Number of Entries Buffered Before Dropping"`
+}
+
+type DnstapConfig struct {
+	EnableDnstap bool   `comment:"Emit Client and Forwarder Messages in dnstap Format"`
+	SocketPath   string `comment:"Unix Socket of dnstap Collector (Example: /run/dnstap.sock)"`
+	FilePath     string `comment:"dnstap Output File, Used When SocketPath is Empty"`
+	Identity     string `comment:"Server Identity in dnstap Messages (Empty to Use Hostname)"`
+	BufferSize   int    `comment:"Number of Messages Buffered Before Dropping"`
+}
+
+type StatsConfig struct {
+	EnableStats     bool `comment:"Aggregate Query Statistics for Admin API"`
+	MaxTrackedNames int  `comment:"Max Number of Domains or Clients Counted per 10 Minutes"`
+	RecentQueries   int  `comment:"Number of Recent Queries Kept for Dashboard (0 to Disable)"`
+}
+
+type LocalConfig struct {
+	HostsFilePath string   `comment:"Hosts File Answered Locally (Example: /etc/hosts, Empty to Disable)"`
+	Records       []string `comment:"Local Records (Example: nas.lan A 192.168.1.10,www.lan CNAME nas.lan,lan MX 10 mail.lan,_http._tcp.lan SRV 0 5 80 nas.lan)"`
+	TTL           int      `comment:"TTL of Local Answers (Seconds)"`
+	ZoneFilePaths []string `comment:"RFC 1035 Master Files of Zones Served Authoritatively (Example: /etc/accdns/lab.internal.zone)"`
+}
+
+type FilterConfig struct {
+	EnableFilter      bool     `comment:"Block Queries Matching Filter Lists"`
+	ListFilePaths     []string `comment:"Filter List Files in Hosts, Plain Domain or Adblock Syntax (Example: /etc/accdns/hosts.txt,/etc/accdns/adblock.txt)"`
+	BlockResponse     string   `comment:"Response for Blocked Queries (nxdomain, refused, zero, custom)"`
+	BlockIPv4         string   `comment:"IPv4 Address Answered for Blocked A Queries When BlockResponse Is custom"`
+	BlockIPv6         string   `comment:"IPv6 Address Answered for Blocked AAAA Queries When BlockResponse Is custom"`
+	BlockTTL          int      `comment:"TTL of Answers for Blocked Queries (Seconds)"`
+	ReloadIntervalSec int      `comment:"Interval of Checking Filter Lists for Changes (Seconds, 0 to Disable)"`
+}
+
+type RebindingConfig struct {
+	EnableRebindingProtection bool     `comment:"Check Upstream Answers for Private, Loopback and Link-Local Addresses"`
+	Action                    string   `comment:"What to Do with Such Answers (strip: Remove the Addresses, block: Answer NXDOMAIN)"`
+	AllowedSuffixes           []string `comment:"Domain Suffixes Allowed to Resolve to Private Addresses (Example: lan,corp.example.com)"`
+}
+
+type ACLConfig struct {
+	DefaultAction         string   `comment:"Action for Clients Matching No Rule (allow, deny: Drop Silently, refuse: Answer REFUSED)"`
+	Rules                 []string `comment:"Actions for Client CIDRs or CIDR List Files, First Match Wins (Example: allow:127.0.0.0/8,allow:192.168.0.0/16,refuse:0.0.0.0/0,refuse:::/0)"`
+	Policies              []string `comment:"Policies for Allowed Client CIDRs or CIDR List Files, First Match Wins (Example: kids:192.168.2.0/24,lab:/etc/accdns/lab.txt)"`
+	PolicyUpstreamGroup   []string `comment:"Upstream Group Answering All Queries of a Policy (Example: kids:overseas)"`
+	PolicyFilter          []string `comment:"Whether Filter Lists Apply to Clients of a Policy (Example: kids:true,lab:false)"`
+	PolicyQueriesPerSec   []string `comment:"Rate Limit of Queries for Clients of a Policy, Overriding [RateLimit] (Example: kids:20,lab:0)"`
+	PolicyResponsesPerSec []string `comment:"Rate Limit of Identical Responses for Clients of a Policy, Overriding [RateLimit] (Example: kids:5)"`
+}
+
+type RateLimitConfig struct {
+	EnableRateLimit bool `comment:"Limit UDP Queries and Identical UDP Responses per Client Prefix"`
+	QueriesPerSec   int  `comment:"Max Queries per Second from One Client Prefix (0 for Unlimited)"`
+	ResponsesPerSec int  `comment:"Max Identical Responses per Second to One Client Prefix (0 for Unlimited)"`
+	Slip            int  `comment:"Answer Every Nth Limited Packet with a Truncated Response so Real Clients Retry over TCP (0 to Drop All)"`
+	IPv4PrefixLen   int  `comment:"Length of IPv4 Prefixes Sharing One Limit"`
+	IPv6PrefixLen   int  `comment:"Length of IPv6 Prefixes Sharing One Limit"`
+	MaxBuckets      int  `comment:"Max Tracked Client Prefixes and Max Tracked Responses, Least Recently Used Evicted First"`
+}
+
+type DNSSECConfig struct {
+	EnableValidation    bool   `comment:"Validate Upstream Responses with DNSSEC, Answering SERVFAIL for Bogus Data and Setting AD for Secure Data"`
+	TrustAnchorFilePath string `comment:"File of DS or DNSKEY Records Trusted as Anchors (Example: /etc/accdns/root.key, Empty to Use Built-in Root Anchors)"`
+}
+
+type AdminConfig struct {
+	ListenAddr string `comment:"Admin API Listen Address (Example: 127.0.0.1:5380 or unix:/run/accdns.sock, Empty to Disable)"`
+	Token      string `comment:"Bearer Token Required by Admin API"`
+}
+
 type AdvancedConfig struct {
 	NSLookupTimeoutMs     int
 	RWTimeoutMs           int
 	MaxReceivedPacketSize int
 	ConnectionTimeout     int
 	NetworkFailedRetries  int
+	RandomizeQueryCase    bool
 }
 
 type CacheConfig struct {
-	EnableCache bool
-	MaxTTL      int
-	MinTTL      int
+	EnableCache              bool
+	MaxTTL                   int
+	MinTTL                   int
+	ServeStale               bool   `comment:"Serve Expired Entries When Upstreams Fail (RFC 8767)"`
+	StaleTTL                 int    `comment:"How Long Expired Entries Are Kept for Serve-Stale (Seconds)"`
+	StaleAnswerTTL           int    `comment:"TTL of Stale Answers Sent to Clients (Seconds)"`
+	StaleClientTimeoutMs     int    `comment:"Max Time to Wait for Refresh Before Answering with Stale Data (Ms)"`
+	Prefetch                 bool   `comment:"Refresh Popular Entries Before They Expire"`
+	PrefetchMinHits          int    `comment:"Min Hits Within One TTL for an Entry to Be Prefetched"`
+	PrefetchThresholdPercent int    `comment:"Prefetch When Remaining TTL Drops Below This Percentage of TTL"`
+	SnapshotFilePath         string `comment:"Cache Snapshot File Path (Empty to Disable Persistence)"`
+	SnapshotIntervalSec      int    `comment:"Interval of Periodic Cache Snapshots (Seconds, 0 to Save Only on Shutdown)"`
+	Shards                   int    `comment:"Number of Independently Locked Cache Shards"`
+	MaxEntries               int    `comment:"Max Number of Cache Entries, Least Recently Used Are Evicted First (0 for Unlimited)"`
+	WarmUpFilePath           string `comment:"File of \"name type\" Lines Resolved at Startup to Prime the Cache (Empty to Disable)"`
+	WarmUpConcurrency        int    `comment:"Max Number of Concurrent Warm-Up Queries"`
+	WarmUpBeforeListen       bool   `comment:"Finish Warm-Up Before Listeners Open"`
 }
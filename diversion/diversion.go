@@ -3,17 +3,23 @@ package diversion
 import (
 	"accdns/cache"
 	"accdns/common"
+	"accdns/dnstap"
 	"accdns/logger"
+	"accdns/metrics"
 	"accdns/network"
-	"errors"
+	"accdns/querylog"
+	"accdns/stats"
 	"golang.org/x/net/dns/dnsmessage"
-	"sync/atomic"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var totalQueryCount uint64
-
-func HandlePacket(bytes []byte, respCall func([]byte), dnsCache *cache.Cache) error {
+func HandlePacket(settings *Settings, bytes []byte, respCall func([]byte) string, dnsCache *cache.Cache, client *Client) error {
+	metrics.BeginQuery()
+	defer metrics.EndQuery()
+	startAt := time.Now()
 	msg := dnsmessage.Message{}
 	if err := msg.Unpack(bytes); err != nil {
 		return err
@@ -24,32 +30,61 @@ func HandlePacket(bytes []byte, respCall func([]byte), dnsCache *cache.Cache) er
 
 	maxPacketSize := common.StandardMaxDNSPacketSize
 	supportEDNS := false
+	dnssecOK := false
+	var ecsOption *dnsmessage.Option
 	for _, res := range msg.Additionals {
 		if res.Header.Type == dnsmessage.TypeOPT {
 			supportEDNS = true
 			maxPacketSize = common.IntMax(int(res.Header.Class), common.StandardMaxDNSPacketSize)
+			dnssecOK = res.Header.DNSSECAllowed()
+			if optRes, ok := res.Body.(*dnsmessage.OPTResource); ok {
+				for i := range optRes.Options {
+					if optRes.Options[i].Code == common.EDNSOptionCodeClientSubnet {
+						ecsOption = &optRes.Options[i]
+					}
+				}
+			}
 			break
 		}
 	}
 	ednsRes := dnsmessage.Resource{
-		Header: dnsmessage.ResourceHeader{
-			Name:  dnsmessage.MustNewName("."),
-			Type:  dnsmessage.TypeOPT,
-			Class: dnsmessage.Class(maxPacketSize),
-		},
 		Body: &dnsmessage.OPTResource{},
 	}
+	if err := ednsRes.Header.SetEDNS0(maxPacketSize, dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		return err
+	}
+	upstreamEDNSRes := dnsmessage.Resource{
+		Body: &dnsmessage.OPTResource{},
+	}
+	upstreamPacketSize := maxPacketSize
+	if settings.Anchors != nil {
+		upstreamPacketSize = common.IntMax(maxPacketSize, common.Config.Advanced.MaxReceivedPacketSize)
+	}
+	if err := upstreamEDNSRes.Header.SetEDNS0(upstreamPacketSize, dnsmessage.RCodeSuccess, dnssecOK || settings.Anchors != nil); err != nil {
+		return err
+	}
+	if ecsOption != nil {
+		upstreamEDNSRes.Body = &dnsmessage.OPTResource{
+			Options: []dnsmessage.Option{*ecsOption},
+		}
+	}
 
+	localMsgs := make([]*upstreamAnswer, len(msg.Questions))
+	groups := make([]string, len(msg.Questions))
 	numOfQueries := 0
-	for _, question := range msg.Questions {
-		queryType := dnsmessage.Type(0)
-		if len(network.UpstreamsList[question.Type]) != 0 {
-			queryType = question.Type
+	for id, question := range msg.Questions {
+		if localMsgs[id] = settings.answerLocally(&question, client); localMsgs[id] != nil {
+			continue
+		}
+		groups[id] = settings.selectGroup(&question, client)
+		if settings.useGeoIP(groups[id]) {
+			numOfQueries++
+			continue
 		}
-		numOfQueries += len(network.UpstreamsList[queryType])
+		numOfQueries += len(settings.Upstreams.Groups[groups[id]])
 	}
 
-	msgChan := make(chan *dnsmessage.Message, numOfQueries)
+	msgChan := make(chan *upstreamAnswer, numOfQueries)
 	idChan := make(chan int, numOfQueries)
 	retChan := make(chan bool, numOfQueries)
 	receivedList := make([]bool, len(msg.Questions))
@@ -57,43 +92,52 @@ func HandlePacket(bytes []byte, respCall func([]byte), dnsCache *cache.Cache) er
 		if common.NeedDebug() {
 			logger.Debug("Question", question.Name, question.Type, question.Class)
 		}
-		queryType := dnsmessage.Type(0)
-		if len(network.UpstreamsList[question.Type]) != 0 {
-			queryType = question.Type
+		if localMsgs[id] != nil {
+			continue
 		}
 		newMsg := dnsmessage.Message{
 			Header: dnsmessage.Header{
-				ID:               uint16(atomic.AddUint64(&totalQueryCount, 1) % 65536),
 				OpCode:           msg.Header.OpCode,
 				RCode:            dnsmessage.RCodeSuccess,
 				RecursionDesired: msg.RecursionDesired,
+				CheckingDisabled: msg.CheckingDisabled,
 			},
 			Questions:   make([]dnsmessage.Question, 1),
 			Additionals: make([]dnsmessage.Resource, 0),
 		}
 		newMsg.Questions[0] = question
-		if maxPacketSize > common.StandardMaxDNSPacketSize {
-			newMsg.Additionals = append(newMsg.Additionals, ednsRes)
+		if maxPacketSize > common.StandardMaxDNSPacketSize || dnssecOK || ecsOption != nil || settings.Anchors != nil {
+			newMsg.Additionals = append(newMsg.Additionals, upstreamEDNSRes)
 		}
-		for _, upstream := range network.UpstreamsList[queryType] {
-			go func(upstream *network.SocketAddr) {
+		group := groups[id]
+		if settings.useGeoIP(group) {
+			go func(id int) {
 				defer func() {
 					retChan <- true
 				}()
-				var receivedMsg *dnsmessage.Message
-				var err error
-				if dnsCache != nil {
-					receivedMsg, err = dnsCache.QueryAndUpdate(&newMsg, upstream, requestUpstreamDNS)
-				} else {
-					receivedMsg, err = requestUpstreamDNS(&newMsg, upstream)
+				answer, err := settings.resolveByGeoIP(&newMsg, dnsCache)
+				if err != nil {
+					return
 				}
+
+				idChan <- id
+				msgChan <- answer
+			}(id)
+			continue
+		}
+		for _, upstream := range settings.Upstreams.Groups[group] {
+			go func(id int, upstream *network.SocketAddr) {
+				defer func() {
+					retChan <- true
+				}()
+				answer, err := settings.queryGroupUpstream(&newMsg, group, upstream, dnsCache)
 				if err != nil {
 					return
 				}
 
 				idChan <- id
-				msgChan <- receivedMsg
-			}(upstream)
+				msgChan <- answer
+			}(id, upstream)
 		}
 	}
 
@@ -113,7 +157,30 @@ func HandlePacket(bytes []byte, respCall func([]byte), dnsCache *cache.Cache) er
 
 	timer := time.NewTimer(time.Duration(common.Config.Advanced.NSLookupTimeoutMs) * time.Millisecond)
 	retServerCounter := 0
-	appendMsgToResp := func(myMsg *dnsmessage.Message) {
+	numOfAppended := 0
+	authenticated := true
+	usedUpstreams := make([]string, 0)
+	cacheStatus := ""
+	appendMsgToResp := func(answer *upstreamAnswer) {
+		myMsg := answer.msg
+		numOfAppended++
+		if answer.upstream != "" && !hasUpstream(usedUpstreams, answer.upstream) {
+			usedUpstreams = append(usedUpstreams, answer.upstream)
+		}
+		if cacheStatus == "" {
+			cacheStatus = answer.cacheStatus
+		}
+		if !myMsg.Header.AuthenticData {
+			authenticated = false
+		}
+		if !dnssecOK {
+			myMsg = &dnsmessage.Message{
+				Header:      myMsg.Header,
+				Answers:     stripDNSSECRecords(myMsg.Answers),
+				Authorities: stripDNSSECRecords(myMsg.Authorities),
+				Additionals: stripDNSSECRecords(myMsg.Additionals),
+			}
+		}
 		if respMsg.Header.RCode != dnsmessage.RCodeSuccess {
 			respMsg.Header.RCode = myMsg.Header.RCode
 		}
@@ -134,22 +201,29 @@ func HandlePacket(bytes []byte, respCall func([]byte), dnsCache *cache.Cache) er
 			}
 		}
 	}
+	allReceived := func() bool {
+		for _, received := range receivedList {
+			if !received {
+				return false
+			}
+		}
+		return true
+	}
+	for id, localMsg := range localMsgs {
+		if localMsg != nil {
+			appendMsgToResp(localMsg)
+			receivedList[id] = true
+		}
+	}
 loop:
-	for {
+	for numOfQueries > 0 && !allReceived() {
 		select {
-		case myMsg := <-msgChan:
-			appendMsgToResp(myMsg)
-			if myMsg.RCode == dnsmessage.RCodeSuccess {
+		case answer := <-msgChan:
+			appendMsgToResp(answer)
+			if answer.msg.RCode == dnsmessage.RCodeSuccess {
 				receivedList[<-idChan] = true
 			}
-			allReceived := true
-			for _, received := range receivedList {
-				if !received {
-					allReceived = false
-					break
-				}
-			}
-			if allReceived {
+			if allReceived() {
 				break loop
 			}
 		case <-retChan:
@@ -157,8 +231,8 @@ loop:
 			if retServerCounter >= numOfQueries {
 				for {
 					select {
-					case myMsg := <-msgChan:
-						appendMsgToResp(myMsg)
+					case answer := <-msgChan:
+						appendMsgToResp(answer)
 					default:
 						break loop
 					}
@@ -170,6 +244,9 @@ loop:
 
 	}
 
+	if settings.Anchors != nil && numOfAppended > 0 && authenticated && (dnssecOK || msg.Header.AuthenticData) {
+		respMsg.Header.AuthenticData = true
+	}
 	if supportEDNS {
 		respMsg.Additionals = append(respMsg.Additionals, ednsRes)
 	}
@@ -181,23 +258,139 @@ loop:
 	if common.NeedDebug() {
 		logger.Debug("Pack DNS Message", respMsg.GoString())
 	}
-	respCall(respBytes)
+	countQuery(&respMsg, client)
+	if status := respCall(respBytes); status != "" {
+		cacheStatus = status
+	}
+	recordQuery(&respMsg, client, usedUpstreams, cacheStatus, startAt)
 	return nil
 }
 
+func countQuery(respMsg *dnsmessage.Message, client *Client) {
+	listener := "unknown"
+	if client != nil {
+		listener = client.Transport
+	}
+	qType := "NONE"
+	if len(respMsg.Questions) > 0 {
+		qType = network.GroupName(respMsg.Questions[0].Type)
+	}
+	metrics.Queries.Inc(listener, qType, strings.TrimPrefix(respMsg.Header.RCode.String(), "RCode"))
+}
+
+func recordQuery(respMsg *dnsmessage.Message, client *Client, upstreams []string, cacheStatus string, startAt time.Time) {
+	if !querylog.Enabled() && !stats.Enabled() {
+		return
+	}
+	entry := &querylog.Entry{
+		Time:      startAt.Format(time.RFC3339Nano),
+		RCode:     strings.TrimPrefix(respMsg.Header.RCode.String(), "RCode"),
+		Answers:   querylog.FormatAnswers(respMsg.Answers),
+		Upstreams: upstreams,
+		Cache:     cacheStatus,
+		LatencyMs: float64(time.Since(startAt).Microseconds()) / 1000,
+	}
+	clientIP := ""
+	if client != nil {
+		entry.Transport = client.Transport
+		if client.IP != nil {
+			clientIP = client.IP.String()
+			entry.Client = net.JoinHostPort(clientIP, strconv.Itoa(client.Port))
+		}
+	}
+	if len(respMsg.Questions) > 0 {
+		entry.Name = respMsg.Questions[0].Name.String()
+		entry.Type = strings.TrimPrefix(respMsg.Questions[0].Type.String(), "Type")
+		entry.Class = strings.TrimPrefix(respMsg.Questions[0].Class.String(), "Class")
+	}
+	querylog.Log(entry)
+	stats.RecordQuery(entry, clientIP, cacheStatus == cacheStatusBlocked)
+}
+
+func hasUpstream(upstreams []string, upstream string) bool {
+	for _, item := range upstreams {
+		if item == upstream {
+			return true
+		}
+	}
+	return false
+}
+
+func (settings *Settings) selectGroup(question *dnsmessage.Question, client *Client) string {
+	if client != nil && client.Policy != nil && client.Policy.UpstreamGroup != "" {
+		return client.Policy.UpstreamGroup
+	}
+	if int(question.Type) < len(settings.Upstreams.List) && len(settings.Upstreams.List[question.Type]) != 0 {
+		return network.GroupName(question.Type)
+	}
+	return network.GroupName(dnsmessage.Type(0))
+}
+
+func RefusePacket(bytes []byte, client *Client, startAt time.Time) ([]byte, error) {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(bytes); err != nil {
+		return nil, err
+	}
+	respMsg := emptyResponse(&msg, dnsmessage.RCodeRefused, false)
+	countQuery(respMsg, client)
+	recordQuery(respMsg, client, make([]string, 0), cacheStatusRefused, startAt)
+	return respMsg.Pack()
+}
+
+func SlipPacket(bytes []byte, client *Client, startAt time.Time) ([]byte, error) {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(bytes); err != nil {
+		return nil, err
+	}
+	respMsg := emptyResponse(&msg, msg.Header.RCode, true)
+	countQuery(respMsg, client)
+	recordQuery(respMsg, client, make([]string, 0), StatusSlipped, startAt)
+	return respMsg.Pack()
+}
+
+func TruncatePacket(bytes []byte) ([]byte, error) {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(bytes); err != nil {
+		return nil, err
+	}
+	return emptyResponse(&msg, msg.Header.RCode, true).Pack()
+}
+
+func emptyResponse(msg *dnsmessage.Message, rCode dnsmessage.RCode, truncated bool) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               msg.Header.ID,
+			Response:         true,
+			OpCode:           msg.Header.OpCode,
+			Truncated:        truncated,
+			RecursionDesired: msg.Header.RecursionDesired,
+			RCode:            rCode,
+		},
+		Questions: msg.Questions,
+	}
+}
+
 func requestUpstreamDNS(msg *dnsmessage.Message, upstreamAddr *network.SocketAddr) (*dnsmessage.Message, error) {
 
 	if common.NeedDebug() {
 		logger.Debug("Request Upstream", upstreamAddr)
 	}
-	bytes, err := msg.Pack()
+	metrics.UpstreamRequests.Inc(upstreamAddr.String())
+	startAt := time.Now()
+	queryMsg, err := newUpstreamQuery(msg)
+	if err != nil {
+		logger.Warning("Prepare DNS Packet", err)
+		return nil, err
+	}
+	bytes, err := queryMsg.Pack()
 	if err != nil {
 		logger.Warning("Pack DNS Packet", err)
 		return nil, err
 	}
 	if common.NeedDebug() {
-		logger.Debug("Pack DNS Message", msg.GoString())
+		logger.Debug("Pack DNS Message", queryMsg.GoString())
 	}
+	dnstap.ForwarderQuery(upstreamAddr, bytes, startAt)
 	var conn *network.SocketConn
 	var readBytes []byte
 	var networkErr error
@@ -224,20 +417,29 @@ func requestUpstreamDNS(msg *dnsmessage.Message, upstreamAddr *network.SocketAdd
 		}()
 	}
 	if networkErr != nil {
+		metrics.UpstreamErrors.Inc(upstreamAddr.String())
+		stats.RecordUpstream(upstreamAddr.String(), time.Since(startAt), true)
 		return nil, networkErr
 	}
+	dnstap.ForwarderResponse(upstreamAddr, readBytes, startAt)
 	receivedMsg := &dnsmessage.Message{}
 	if err := receivedMsg.Unpack(readBytes); err != nil {
 		logger.Warning("Unpack DNS Packet", err)
+		metrics.UpstreamErrors.Inc(upstreamAddr.String())
+		stats.RecordUpstream(upstreamAddr.String(), time.Since(startAt), true)
 		return nil, err
 	}
 	if common.NeedDebug() {
 		logger.Debug("Unpack DNS Message", receivedMsg.GoString())
 	}
-	if msg.ID != receivedMsg.ID {
-		err = errors.New("response id is not match")
-		logger.Warning("Check DNS Packet", err)
+	if err := checkUpstreamResponse(queryMsg, receivedMsg); err != nil {
+		logger.Warning("Check DNS Packet", upstreamAddr, err)
+		metrics.UpstreamErrors.Inc(upstreamAddr.String())
+		stats.RecordUpstream(upstreamAddr.String(), time.Since(startAt), true)
 		return nil, err
 	}
+	metrics.UpstreamLatency.Observe(time.Since(startAt).Seconds(), upstreamAddr.String())
+	stats.RecordUpstream(upstreamAddr.String(), time.Since(startAt), false)
+	restoreQuestionCase(msg, queryMsg, receivedMsg)
 	return receivedMsg, nil
 }
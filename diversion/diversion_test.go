@@ -0,0 +1,31 @@
+package diversion
+
+import (
+	"accdns/network"
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+)
+
+func TestSelectGroupBeyondTypeList(t *testing.T) {
+	upstream, err := network.ParseNewSocketAddr("127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &Settings{Upstreams: &network.Upstreams{}}
+	settings.Upstreams.List[dnsmessage.TypeA] = []*network.SocketAddr{upstream}
+	tests := []struct {
+		qType dnsmessage.Type
+		group string
+	}{
+		{dnsmessage.TypeA, "A"},
+		{dnsmessage.TypeAAAA, "default"},
+		{dnsmessage.Type(257), "default"},
+		{dnsmessage.Type(65535), "default"},
+	}
+	for _, test := range tests {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: test.qType, Class: dnsmessage.ClassINET}
+		if group := settings.selectGroup(&question, nil); group != test.group {
+			t.Errorf("type %d: got group %q, want %q", test.qType, group, test.group)
+		}
+	}
+}
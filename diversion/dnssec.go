@@ -0,0 +1,75 @@
+package diversion
+
+import (
+	"accdns/common"
+	"accdns/dnssec"
+	"accdns/logger"
+	"accdns/metrics"
+	"accdns/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func (settings *Settings) validateResponse(queryMsg *dnsmessage.Message, receivedMsg *dnsmessage.Message, upstreamAddr *network.SocketAddr) *dnsmessage.Message {
+	if settings.Anchors == nil {
+		return receivedMsg
+	}
+	if queryMsg.Header.CheckingDisabled {
+		receivedMsg.Header.AuthenticData = false
+		return receivedMsg
+	}
+	result, err := settings.Anchors.Validate(receivedMsg, func(name dnsmessage.Name, qType dnsmessage.Type) (*dnsmessage.Message, error) {
+		return requestUpstreamDNS(newValidationQuery(name, qType), upstreamAddr)
+	})
+	switch result {
+	case dnssec.ResultSecure:
+		metrics.DNSSECValidations.Inc("secure")
+		receivedMsg.Header.AuthenticData = true
+	case dnssec.ResultInsecure:
+		metrics.DNSSECValidations.Inc("insecure")
+		receivedMsg.Header.AuthenticData = false
+	default:
+		metrics.DNSSECValidations.Inc("bogus")
+		logger.Warning("DNSSEC Validate", upstreamAddr, queryMsg.Questions[0].Name, queryMsg.Questions[0].Type, err)
+		return &dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:                 receivedMsg.Header.ID,
+				Response:           true,
+				OpCode:             receivedMsg.Header.OpCode,
+				RecursionDesired:   receivedMsg.Header.RecursionDesired,
+				RecursionAvailable: receivedMsg.Header.RecursionAvailable,
+				RCode:              dnsmessage.RCodeServerFailure,
+			},
+			Questions: receivedMsg.Questions,
+		}
+	}
+	return receivedMsg
+}
+
+func newValidationQuery(name dnsmessage.Name, qType dnsmessage.Type) *dnsmessage.Message {
+	ednsRes := dnsmessage.Resource{
+		Body: &dnsmessage.OPTResource{},
+	}
+	_ = ednsRes.Header.SetEDNS0(common.Config.Advanced.MaxReceivedPacketSize, dnsmessage.RCodeSuccess, true)
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			RecursionDesired: true,
+			CheckingDisabled: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qType,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{ednsRes},
+	}
+}
+
+func stripDNSSECRecords(resources []dnsmessage.Resource) []dnsmessage.Resource {
+	stripped := make([]dnsmessage.Resource, 0, len(resources))
+	for _, res := range resources {
+		if !dnssec.IsDNSSECType(res.Header.Type) {
+			stripped = append(stripped, res)
+		}
+	}
+	return stripped
+}
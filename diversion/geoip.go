@@ -0,0 +1,116 @@
+package diversion
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/logger"
+	"accdns/network"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func (settings *Settings) initGeoIP(config *common.ConfigStruct, upstreams *network.Upstreams) error {
+	if !config.GeoIP.EnableGeoIP {
+		return nil
+	}
+	if _, ok := upstreams.Groups[config.GeoIP.DomesticGroup]; !ok {
+		return errors.New("domestic upstream group \"" + config.GeoIP.DomesticGroup + "\" does not exist")
+	}
+	if _, ok := upstreams.Groups[config.GeoIP.OverseasGroup]; !ok {
+		return errors.New("overseas upstream group \"" + config.GeoIP.OverseasGroup + "\" does not exist")
+	}
+	cidrSet, err := network.ParseCIDRSet(config.GeoIP.DomesticCIDRFilePaths)
+	if err != nil {
+		return err
+	}
+	if cidrSet.Len() == 0 {
+		return errors.New("domestic cidr list is empty")
+	}
+	settings.domesticGroup = config.GeoIP.DomesticGroup
+	settings.overseasGroup = config.GeoIP.OverseasGroup
+	settings.domesticCIDRs = cidrSet
+	logger.Info("Load Domestic CIDRs", cidrSet.Len(), "ranges")
+	return nil
+}
+
+func (settings *Settings) useGeoIP(group string) bool {
+	return settings.domesticCIDRs != nil && group == network.GroupName(dnsmessage.Type(0))
+}
+
+func (settings *Settings) resolveByGeoIP(queryMsg *dnsmessage.Message, dnsCache *cache.Cache) (*upstreamAnswer, error) {
+	type groupResult struct {
+		answer *upstreamAnswer
+		err    error
+	}
+	domesticChan := make(chan groupResult, 1)
+	overseasChan := make(chan groupResult, 1)
+	go func() {
+		answer, err := settings.queryGroupFirst(queryMsg, settings.domesticGroup, dnsCache)
+		domesticChan <- groupResult{answer: answer, err: err}
+	}()
+	go func() {
+		answer, err := settings.queryGroupFirst(queryMsg, settings.overseasGroup, dnsCache)
+		overseasChan <- groupResult{answer: answer, err: err}
+	}()
+	domestic := <-domesticChan
+	if domestic.err == nil && settings.isDomesticAnswer(domestic.answer.msg) {
+		if common.NeedDebug() {
+			logger.Debug("Choose Domestic Answer", queryMsg.Questions[0].Name, queryMsg.Questions[0].Type)
+		}
+		return domestic.answer, nil
+	}
+	overseas := <-overseasChan
+	if overseas.err == nil {
+		if common.NeedDebug() {
+			logger.Debug("Choose Overseas Answer", queryMsg.Questions[0].Name, queryMsg.Questions[0].Type)
+		}
+		return overseas.answer, nil
+	}
+	if domestic.err == nil {
+		return domestic.answer, nil
+	}
+	return nil, overseas.err
+}
+
+func (settings *Settings) queryGroupFirst(queryMsg *dnsmessage.Message, group string, dnsCache *cache.Cache) (*upstreamAnswer, error) {
+	upstreams := settings.Upstreams.Groups[group]
+	if len(upstreams) == 0 {
+		return nil, errors.New("upstream group \"" + group + "\" is empty")
+	}
+	type upstreamResult struct {
+		answer *upstreamAnswer
+		err    error
+	}
+	resultChan := make(chan upstreamResult, len(upstreams))
+	for _, upstream := range upstreams {
+		go func(upstream *network.SocketAddr) {
+			answer, err := settings.queryGroupUpstream(queryMsg, group, upstream, dnsCache)
+			resultChan <- upstreamResult{answer: answer, err: err}
+		}(upstream)
+	}
+	var err error
+	for range upstreams {
+		result := <-resultChan
+		if result.err == nil && result.answer.msg.Header.RCode != dnsmessage.RCodeServerFailure {
+			return result.answer, nil
+		}
+		if result.err == nil {
+			err = errors.New("upstream answered " + result.answer.msg.Header.RCode.String())
+		} else {
+			err = result.err
+		}
+	}
+	return nil, err
+}
+
+func (settings *Settings) isDomesticAnswer(msg *dnsmessage.Message) bool {
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return false
+	}
+	for _, ip := range answerIPs(msg) {
+		if !settings.domesticCIDRs.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
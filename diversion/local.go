@@ -0,0 +1,27 @@
+package diversion
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"accdns/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func (settings *Settings) answerLocally(question *dnsmessage.Question, client *Client) *upstreamAnswer {
+	if localMsg := settings.Records.Lookup(question); localMsg != nil {
+		if common.NeedDebug() {
+			logger.Debug("Answer Locally", question.Name, question.Type)
+		}
+		metrics.FilterDecisions.Inc("local")
+		return &upstreamAnswer{msg: localMsg, cacheStatus: cacheStatusLocal}
+	}
+	if client != nil && client.Policy != nil && client.Policy.DisableFilter {
+		return nil
+	}
+	if settings.Filter.Match(question.Name.String()) {
+		logger.Info("Block Query", question.Name, question.Type)
+		metrics.FilterDecisions.Inc("blocked")
+		return &upstreamAnswer{msg: settings.BlockAction.NewResponse(question), cacheStatus: cacheStatusBlocked}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package diversion
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"accdns/network"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+const (
+	RebindingActionStrip = "strip"
+	RebindingActionBlock = "block"
+)
+
+func (settings *Settings) initRebinding(config *common.ConfigStruct) error {
+	if !config.Rebinding.EnableRebindingProtection {
+		return nil
+	}
+	switch config.Rebinding.Action {
+	case RebindingActionStrip, RebindingActionBlock:
+	default:
+		return errors.New("rebinding action \"" + config.Rebinding.Action + "\" is not correct")
+	}
+	cidrSet, err := network.ParseCIDRSet([]string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	})
+	if err != nil {
+		return err
+	}
+	settings.rebindingAllowedSuffixes = make([]string, 0, len(config.Rebinding.AllowedSuffixes))
+	for _, suffix := range config.Rebinding.AllowedSuffixes {
+		settings.rebindingAllowedSuffixes = append(settings.rebindingAllowedSuffixes, strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), "."))
+	}
+	settings.rebindingAction = config.Rebinding.Action
+	settings.privateCIDRs = cidrSet
+	return nil
+}
+
+func (settings *Settings) protectRebinding(msg *dnsmessage.Message) *dnsmessage.Message {
+	if settings.privateCIDRs == nil || len(msg.Questions) < 1 || settings.isRebindingAllowed(msg.Questions[0].Name.String()) {
+		return msg
+	}
+	answers := make([]dnsmessage.Resource, 0, len(msg.Answers))
+	for _, res := range msg.Answers {
+		var ip net.IP
+		switch body := res.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		}
+		if ip != nil && settings.privateCIDRs.Contains(ip) {
+			logger.Warning("Protect DNS Rebinding", settings.rebindingAction, msg.Questions[0].Name, "resolves to", ip)
+			if settings.rebindingAction == RebindingActionBlock {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+				msg.Answers = make([]dnsmessage.Resource, 0)
+				msg.Authorities = make([]dnsmessage.Resource, 0)
+				msg.Additionals = removeAddressRecords(msg.Additionals)
+				return msg
+			}
+			continue
+		}
+		answers = append(answers, res)
+	}
+	msg.Answers = answers
+	return msg
+}
+
+func removeAddressRecords(resources []dnsmessage.Resource) []dnsmessage.Resource {
+	filtered := make([]dnsmessage.Resource, 0, len(resources))
+	for _, res := range resources {
+		if res.Header.Type != dnsmessage.TypeA && res.Header.Type != dnsmessage.TypeAAAA {
+			filtered = append(filtered, res)
+		}
+	}
+	return filtered
+}
+
+func (settings *Settings) isRebindingAllowed(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, suffix := range settings.rebindingAllowedSuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
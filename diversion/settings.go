@@ -0,0 +1,140 @@
+package diversion
+
+import (
+	"accdns/acl"
+	"accdns/common"
+	"accdns/dnssec"
+	"accdns/filter"
+	"accdns/local"
+	"accdns/logger"
+	"accdns/network"
+	"accdns/ratelimit"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var currentSettings atomic.Pointer[Settings]
+var reloadMutex sync.Mutex
+var filterLoopStopChan chan struct{}
+
+func Init() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	settings, err := Load(common.Config)
+	if err != nil {
+		return err
+	}
+	currentSettings.Store(settings)
+	restartFilterLoop(settings.Config)
+	return nil
+}
+
+func Load(config *common.ConfigStruct) (*Settings, error) {
+	settings := &Settings{Config: config}
+	var err error
+	if settings.Upstreams, err = network.LoadUpstreams(config); err != nil {
+		return nil, err
+	}
+	if err := settings.initGeoIP(config, settings.Upstreams); err != nil {
+		return nil, err
+	}
+	if err := settings.initRebinding(config); err != nil {
+		return nil, err
+	}
+	if settings.ACL, err = acl.Load(config, settings.Upstreams); err != nil {
+		return nil, err
+	}
+	if err := ratelimit.Validate(config); err != nil {
+		return nil, err
+	}
+	if settings.Records, err = local.Load(config); err != nil {
+		return nil, err
+	}
+	if settings.Filter, settings.BlockAction, err = filter.Load(config); err != nil {
+		return nil, err
+	}
+	if settings.Anchors, err = dnssec.Load(config); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func Current() *Settings {
+	return currentSettings.Load()
+}
+
+func Reload(config *common.ConfigStruct) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	settings, err := Load(config)
+	if err != nil {
+		return err
+	}
+	currentSettings.Store(settings)
+	restartFilterLoop(settings.Config)
+	return nil
+}
+
+func ReloadFilter() (int, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	settings := currentSettings.Load()
+	if settings.Filter == nil {
+		return 0, errors.New("filter is disabled")
+	}
+	if err := reloadFilterLists(settings); err != nil {
+		return 0, err
+	}
+	return currentSettings.Load().Filter.NumOfRules, nil
+}
+
+func reloadFilterIfChanged() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	settings := currentSettings.Load()
+	if settings.Filter == nil || !settings.Filter.Changed() {
+		return
+	}
+	if err := reloadFilterLists(settings); err != nil {
+		logger.Warning("Reload Filter Lists", err)
+	}
+}
+
+func reloadFilterLists(settings *Settings) error {
+	ruleSet, err := filter.LoadRuleSet(settings.Config.Filter.ListFilePaths)
+	if err != nil {
+		return err
+	}
+	newSettings := *settings
+	newSettings.Filter = ruleSet
+	currentSettings.Store(&newSettings)
+	logger.Info("Reload Filter Lists", ruleSet.NumOfRules, "rules from", len(settings.Config.Filter.ListFilePaths), "files")
+	return nil
+}
+
+func restartFilterLoop(config *common.ConfigStruct) {
+	if filterLoopStopChan != nil {
+		close(filterLoopStopChan)
+		filterLoopStopChan = nil
+	}
+	if !config.Filter.EnableFilter || config.Filter.ReloadIntervalSec <= 0 {
+		return
+	}
+	filterLoopStopChan = make(chan struct{})
+	go filterLoop(time.Duration(config.Filter.ReloadIntervalSec)*time.Second, filterLoopStopChan)
+}
+
+func filterLoop(interval time.Duration, stopChan chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloadFilterIfChanged()
+		case <-stopChan:
+			return
+		}
+	}
+}
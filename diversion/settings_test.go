@@ -0,0 +1,92 @@
+package diversion
+
+import (
+	"accdns/common"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestConfig(t *testing.T, ip string) *common.ConfigStruct {
+	config, err := common.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Local.Records = []string{"host.lan A " + ip}
+	return config
+}
+
+func TestReloadDuringHandlePacket(t *testing.T) {
+	configs := []*common.ConfigStruct{newTestConfig(t, "10.0.0.1"), newTestConfig(t, "10.0.0.2")}
+	common.Config = configs[0]
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	queryMsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("host.lan."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	queryBytes, err := queryMsg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		for i := 0; i < 200; i++ {
+			if err := Reload(configs[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for worker := 0; worker < 4; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := 0; i < 200; i++ {
+				settings := Current()
+				wantIP := net.ParseIP(strings.Fields(settings.Config.Local.Records[0])[2]).To4()
+				err := HandlePacket(settings, queryBytes, func(respBytes []byte) string {
+					respMsg := dnsmessage.Message{}
+					if err := respMsg.Unpack(respBytes); err != nil {
+						t.Error(err)
+						return ""
+					}
+					if len(respMsg.Answers) != 1 {
+						t.Errorf("got %d answers, want 1", len(respMsg.Answers))
+						return ""
+					}
+					body, ok := respMsg.Answers[0].Body.(*dnsmessage.AResource)
+					if !ok || !net.IP(body.A[:]).Equal(wantIP) {
+						t.Errorf("got answer %v, want %v", respMsg.Answers[0].Body, wantIP)
+					}
+					return ""
+				}, nil, &Client{Transport: "test"})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+}
+
+func TestReloadKeepsSettingsOnError(t *testing.T) {
+	common.Config = newTestConfig(t, "10.0.0.1")
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	before := Current()
+	config := newTestConfig(t, "10.0.0.2")
+	config.Upstream.DefaultUpstreams = []string{"bogus:1.2.3.4"}
+	if err := Reload(config); err == nil {
+		t.Fatal("reload of invalid config succeeded")
+	}
+	if Current() != before {
+		t.Fatal("settings changed after failed reload")
+	}
+}
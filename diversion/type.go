@@ -0,0 +1,41 @@
+package diversion
+
+import (
+	"accdns/acl"
+	"accdns/common"
+	"accdns/dnssec"
+	"accdns/filter"
+	"accdns/local"
+	"accdns/network"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+type Client struct {
+	IP        net.IP
+	Port      int
+	Transport string
+	Policy    *acl.Policy
+}
+
+type Settings struct {
+	Config                   *common.ConfigStruct
+	Upstreams                *network.Upstreams
+	ACL                      *acl.RuleSet
+	Records                  *local.RecordStore
+	Filter                   *filter.RuleSet
+	BlockAction              *filter.BlockAction
+	Anchors                  *dnssec.Anchors
+	domesticGroup            string
+	overseasGroup            string
+	domesticCIDRs            *network.CIDRSet
+	rebindingAction          string
+	privateCIDRs             *network.CIDRSet
+	rebindingAllowedSuffixes []string
+}
+
+type upstreamAnswer struct {
+	msg         *dnsmessage.Message
+	upstream    string
+	cacheStatus string
+}
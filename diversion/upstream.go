@@ -0,0 +1,106 @@
+package diversion
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/logger"
+	"accdns/network"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+const maxGroupFallbacks = 4
+
+const (
+	cacheStatusDisabled = "disabled"
+	cacheStatusLocal    = "local"
+	cacheStatusBlocked  = "blocked"
+	cacheStatusRefused  = "refused"
+	StatusSlipped       = "slipped"
+	StatusDropped       = "dropped"
+)
+
+var errResponseRejected = errors.New("response is rejected by ip filter")
+var upstreamFlights = &cache.FlightGroup{}
+
+func (settings *Settings) queryGroupUpstream(queryMsg *dnsmessage.Message, group string, upstream *network.SocketAddr, dnsCache *cache.Cache) (*upstreamAnswer, error) {
+	answer, err := settings.queryUpstream(queryMsg, group, upstream, dnsCache)
+	for i := 0; i < maxGroupFallbacks && err == errResponseRejected; i++ {
+		ipFilter := settings.Upstreams.IPFilters[group]
+		if ipFilter == nil || ipFilter.Fallback == "" {
+			break
+		}
+		group = ipFilter.Fallback
+		if common.NeedDebug() {
+			logger.Debug("Fall Back to Group", group, queryMsg.Questions[0].Name, queryMsg.Questions[0].Type)
+		}
+		for _, fallbackUpstream := range settings.Upstreams.Groups[group] {
+			answer, err = settings.queryUpstream(queryMsg, group, fallbackUpstream, dnsCache)
+			if err == nil {
+				return answer, nil
+			}
+		}
+	}
+	return answer, err
+}
+
+func (settings *Settings) queryUpstream(queryMsg *dnsmessage.Message, group string, upstream *network.SocketAddr, dnsCache *cache.Cache) (*upstreamAnswer, error) {
+	updateFunc := func(msg *dnsmessage.Message, upstreamAddr *network.SocketAddr) (*dnsmessage.Message, error) {
+		receivedMsg, err := requestUpstreamDNS(msg, upstreamAddr)
+		if err != nil {
+			return nil, err
+		}
+		receivedMsg = settings.validateResponse(msg, receivedMsg, upstreamAddr)
+		if err := settings.checkResponseIPs(group, receivedMsg); err != nil {
+			logger.Warning("Check Response IPs", upstreamAddr, msg.Questions[0].Name, err)
+			return nil, err
+		}
+		return settings.protectRebinding(receivedMsg), nil
+	}
+	answer := &upstreamAnswer{
+		upstream:    upstream.String(),
+		cacheStatus: cacheStatusDisabled,
+	}
+	var err error
+	if dnsCache != nil {
+		answer.msg, answer.cacheStatus, err = dnsCache.QueryAndUpdate(queryMsg, group, upstream, updateFunc)
+	} else {
+		answer.msg, err = upstreamFlights.Do(cache.Key(queryMsg, group)+"|"+upstream.String(), func() (*dnsmessage.Message, error) {
+			return updateFunc(queryMsg, upstream)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+func (settings *Settings) checkResponseIPs(group string, msg *dnsmessage.Message) error {
+	ipFilter := settings.Upstreams.IPFilters[group]
+	if ipFilter == nil || (ipFilter.Blacklist == nil && ipFilter.Allowlist == nil) {
+		return nil
+	}
+	for _, ip := range answerIPs(msg) {
+		if ipFilter.Blacklist.Contains(ip) {
+			return errResponseRejected
+		}
+		if ipFilter.Allowlist != nil && !ipFilter.Allowlist.Contains(ip) {
+			return errResponseRejected
+		}
+	}
+	return nil
+}
+
+func answerIPs(msg *dnsmessage.Message) []net.IP {
+	ips := make([]net.IP, 0)
+	for _, res := range msg.Answers {
+		switch body := res.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips
+}
@@ -0,0 +1,94 @@
+package diversion
+
+import (
+	"accdns/common"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+func newUpstreamQuery(msg *dnsmessage.Message) (*dnsmessage.Message, error) {
+	queryMsg := *msg
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	queryMsg.Header.ID = id
+	queryMsg.Questions = make([]dnsmessage.Question, len(msg.Questions))
+	copy(queryMsg.Questions, msg.Questions)
+	if common.Config.Advanced.RandomizeQueryCase {
+		for i := range queryMsg.Questions {
+			if queryMsg.Questions[i].Name, err = randomizeCase(queryMsg.Questions[i].Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &queryMsg, nil
+}
+
+func randomID() (uint16, error) {
+	randomBytes := make([]byte, 2)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(randomBytes), nil
+}
+
+func randomizeCase(name dnsmessage.Name) (dnsmessage.Name, error) {
+	randomBytes := make([]byte, (name.Length+7)/8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return name, err
+	}
+	for i := 0; i < int(name.Length); i++ {
+		if lower := name.Data[i] | 0x20; lower >= 'a' && lower <= 'z' && randomBytes[i/8]&(1<<(i%8)) != 0 {
+			name.Data[i] ^= 0x20
+		}
+	}
+	return name, nil
+}
+
+func checkUpstreamResponse(queryMsg *dnsmessage.Message, receivedMsg *dnsmessage.Message) error {
+	if queryMsg.Header.ID != receivedMsg.Header.ID {
+		return errors.New("response id is not match")
+	}
+	if !receivedMsg.Header.Response {
+		return errors.New("response flag is not set")
+	}
+	if len(queryMsg.Questions) != len(receivedMsg.Questions) {
+		return errors.New("response question count is not match")
+	}
+	for i, question := range queryMsg.Questions {
+		receivedQuestion := receivedMsg.Questions[i]
+		if question.Type != receivedQuestion.Type || question.Class != receivedQuestion.Class {
+			return errors.New("response question " + receivedQuestion.Name.String() + " " + receivedQuestion.Type.String() + " is not match")
+		}
+		if common.Config.Advanced.RandomizeQueryCase {
+			if question.Name.String() != receivedQuestion.Name.String() {
+				return errors.New("response question " + receivedQuestion.Name.String() + " does not echo case of " + question.Name.String())
+			}
+		} else if !strings.EqualFold(question.Name.String(), receivedQuestion.Name.String()) {
+			return errors.New("response question " + receivedQuestion.Name.String() + " is not match")
+		}
+	}
+	return nil
+}
+
+func restoreQuestionCase(msg *dnsmessage.Message, queryMsg *dnsmessage.Message, receivedMsg *dnsmessage.Message) {
+	if !common.Config.Advanced.RandomizeQueryCase {
+		return
+	}
+	for i := range receivedMsg.Questions {
+		receivedMsg.Questions[i].Name = msg.Questions[i].Name
+	}
+	for _, resources := range [][]dnsmessage.Resource{receivedMsg.Answers, receivedMsg.Authorities, receivedMsg.Additionals} {
+		for i := range resources {
+			for j, question := range queryMsg.Questions {
+				if resources[i].Header.Name == question.Name {
+					resources[i].Header.Name = msg.Questions[j].Name
+				}
+			}
+		}
+	}
+}
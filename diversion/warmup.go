@@ -0,0 +1,131 @@
+package diversion
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/logger"
+	"bufio"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var errWarmUpStopped = errors.New("warm up is stopped by shutdown")
+
+func WarmUp(filePath string, concurrency int, dnsCache *cache.Cache, stopChan <-chan struct{}) (warmed int, failed int, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var warmedCount, failedCount int64
+	questionChan := make(chan dnsmessage.Question, concurrency)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for question := range questionChan {
+				if err := warmUpQuestion(question, dnsCache); err != nil {
+					logger.Warning("Warm Up Cache", question.Name, question.Type, err)
+					atomic.AddInt64(&failedCount, 1)
+					continue
+				}
+				atomic.AddInt64(&warmedCount, 1)
+			}
+		}()
+	}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	stopped := false
+	for !stopped && scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		question, err := parseWarmUpLine(line)
+		if err != nil {
+			logger.Warning("Warm Up Cache", "line", lineNum, err)
+			atomic.AddInt64(&failedCount, 1)
+			continue
+		}
+		select {
+		case questionChan <- question:
+		case <-stopChan:
+			stopped = true
+		}
+	}
+	close(questionChan)
+	waitGroup.Wait()
+	if stopped {
+		return int(warmedCount), int(failedCount), errWarmUpStopped
+	}
+	if err := scanner.Err(); err != nil {
+		return int(warmedCount), int(failedCount), err
+	}
+	return int(warmedCount), int(failedCount), nil
+}
+
+func parseWarmUpLine(line string) (dnsmessage.Question, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return dnsmessage.Question{}, errors.New("warm-up line \"" + line + "\" is not correct")
+	}
+	name := fields[0]
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Question{}, err
+	}
+	qType := dnsmessage.TypeA
+	if len(fields) == 2 {
+		qType, err = common.ParseRecordType(fields[1])
+		if err != nil {
+			return dnsmessage.Question{}, err
+		}
+	}
+	return dnsmessage.Question{
+		Name:  qName,
+		Type:  qType,
+		Class: dnsmessage.ClassINET,
+	}, nil
+}
+
+func warmUpQuestion(question dnsmessage.Question, dnsCache *cache.Cache) error {
+	queryMsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	queryBytes, err := queryMsg.Pack()
+	if err != nil {
+		return err
+	}
+	var respBytes []byte
+	if err := HandlePacket(Current(), queryBytes, func(bytes []byte) string {
+		respBytes = bytes
+		return ""
+	}, dnsCache, &Client{Transport: "warmup"}); err != nil {
+		return err
+	}
+	respMsg := dnsmessage.Message{}
+	if err := respMsg.Unpack(respBytes); err != nil {
+		return err
+	}
+	if respMsg.Header.RCode == dnsmessage.RCodeServerFailure || respMsg.Header.RCode == dnsmessage.RCodeRefused {
+		return errors.New("upstream answered " + respMsg.Header.RCode.String())
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+const (
+	nsec3FlagOptOut    = 0x01
+	nsec3HashSHA1      = 1
+	maxNSEC3Iterations = 150
+)
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func parseNSEC(owner string, data []byte) (*nsecRecord, error) {
+	next, offset, err := wireToName(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &nsecRecord{owner: owner, next: next, types: data[offset:]}, nil
+}
+
+func parseNSEC3(owner string, data []byte) (*nsec3Record, error) {
+	if len(data) < 5 {
+		return nil, errors.New("nsec3 record is truncated")
+	}
+	record := &nsec3Record{
+		owner:      owner,
+		algorithm:  data[0],
+		flags:      data[1],
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+	}
+	offset := 4
+	saltLen := int(data[offset])
+	offset++
+	if offset+saltLen >= len(data) {
+		return nil, errors.New("nsec3 record is truncated")
+	}
+	record.salt = data[offset : offset+saltLen]
+	offset += saltLen
+	hashLen := int(data[offset])
+	offset++
+	if offset+hashLen > len(data) {
+		return nil, errors.New("nsec3 record is truncated")
+	}
+	record.nextHash = data[offset : offset+hashLen]
+	record.types = data[offset+hashLen:]
+	labels := nameLabels(owner)
+	if len(labels) == 0 {
+		return nil, errors.New("nsec3 owner name is not correct")
+	}
+	hash, err := nsec3Encoding.DecodeString(strings.ToUpper(labels[0]))
+	if err != nil {
+		return nil, err
+	}
+	record.hash = hash
+	return record, nil
+}
+
+func hasType(bitmap []byte, rrType dnsmessage.Type) bool {
+	window := byte(uint16(rrType) >> 8)
+	index := int(uint16(rrType) & 0xFF)
+	for offset := 0; offset+2 <= len(bitmap); {
+		blockWindow := bitmap[offset]
+		blockLen := int(bitmap[offset+1])
+		offset += 2
+		if offset+blockLen > len(bitmap) {
+			return false
+		}
+		if blockWindow == window {
+			return index/8 < blockLen && bitmap[offset+index/8]&(0x80>>(index%8)) != 0
+		}
+		offset += blockLen
+	}
+	return false
+}
+
+func (record *nsecRecord) covers(name string) bool {
+	if compareNames(record.owner, name) >= 0 {
+		return false
+	}
+	return compareNames(name, record.next) < 0 || compareNames(record.next, record.owner) <= 0
+}
+
+func (record *nsec3Record) zone() string {
+	return parentName(record.owner)
+}
+
+func (record *nsec3Record) hashName(name string) []byte {
+	hasher := sha1.New()
+	hasher.Write(nameToWire(name))
+	hasher.Write(record.salt)
+	hash := hasher.Sum(nil)
+	for i := 0; i < int(record.iterations); i++ {
+		hasher.Reset()
+		hasher.Write(hash)
+		hasher.Write(record.salt)
+		hash = hasher.Sum(nil)
+	}
+	return hash
+}
+
+func (record *nsec3Record) matches(name string) bool {
+	return isSubdomain(name, record.zone()) && bytes.Equal(record.hashName(name), record.hash)
+}
+
+func (record *nsec3Record) covers(name string) bool {
+	if !isSubdomain(name, record.zone()) {
+		return false
+	}
+	hash := record.hashName(name)
+	if bytes.Compare(record.hash, hash) >= 0 {
+		return bytes.Compare(record.nextHash, record.hash) <= 0 && bytes.Compare(hash, record.nextHash) < 0
+	}
+	return bytes.Compare(hash, record.nextHash) < 0 || bytes.Compare(record.nextHash, record.hash) <= 0
+}
+
+func provesNoData(name string, qType dnsmessage.Type, nsecs []*nsecRecord, nsec3s []*nsec3Record) bool {
+	for _, record := range nsecs {
+		if record.owner == name {
+			if qType != TypeDS && isDelegation(record.types) {
+				return false
+			}
+			return !hasType(record.types, qType) && !hasType(record.types, dnsmessage.TypeCNAME)
+		}
+		if isDelegation(record.types) && isSubdomain(name, record.owner) {
+			continue
+		}
+		if compareNames(record.owner, name) < 0 && isSubdomain(record.next, name) && record.next != name {
+			return true
+		}
+	}
+	for _, record := range nsec3s {
+		if record.matches(name) {
+			if qType != TypeDS && isDelegation(record.types) {
+				return false
+			}
+			return !hasType(record.types, qType) && !hasType(record.types, dnsmessage.TypeCNAME)
+		}
+	}
+	if qType == TypeDS {
+		if _, nextCloser := closestEncloser(name, nsec3s); nextCloser != "" {
+			for _, record := range nsec3s {
+				if record.flags&nsec3FlagOptOut != 0 && record.covers(nextCloser) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func provesNameError(name string, nsecs []*nsecRecord, nsec3s []*nsec3Record) bool {
+	for _, record := range nsecs {
+		if !record.covers(name) {
+			continue
+		}
+		encloser := commonAncestor(name, record.owner)
+		if nextEncloser := commonAncestor(name, record.next); len(nextEncloser) > len(encloser) {
+			encloser = nextEncloser
+		}
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+		for _, wildcardRecord := range nsecs {
+			if wildcardRecord.covers(wildcard) {
+				return true
+			}
+		}
+	}
+	encloser, nextCloser := closestEncloser(name, nsec3s)
+	if nextCloser == "" {
+		return false
+	}
+	nextCloserCovered := false
+	optOut := false
+	for _, record := range nsec3s {
+		if record.covers(nextCloser) {
+			nextCloserCovered = true
+			optOut = record.flags&nsec3FlagOptOut != 0
+		}
+	}
+	if !nextCloserCovered {
+		return false
+	}
+	if optOut {
+		return true
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	for _, record := range nsec3s {
+		if record.covers(wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+func provesWildcardExpansion(name string, labels int, nsecs []*nsecRecord, nsec3s []*nsec3Record) bool {
+	for _, record := range nsecs {
+		if record.covers(name) && labelCount(commonAncestor(name, record.owner)) <= labels && labelCount(commonAncestor(name, record.next)) <= labels {
+			return true
+		}
+	}
+	nextCloser := ancestorName(name, labels+1)
+	for _, record := range nsec3s {
+		if record.covers(nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+func closestEncloser(name string, nsec3s []*nsec3Record) (string, string) {
+	nextCloser := ""
+	for candidate := name; ; candidate = parentName(candidate) {
+		for _, record := range nsec3s {
+			if record.matches(candidate) {
+				return candidate, nextCloser
+			}
+		}
+		if candidate == "." {
+			return "", ""
+		}
+		nextCloser = candidate
+	}
+}
+
+func usableNSEC3(nsec3s []*nsec3Record) bool {
+	for _, record := range nsec3s {
+		if record.algorithm != nsec3HashSHA1 || record.iterations > maxNSEC3Iterations {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,644 @@
+package dnssec
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ResultInsecure Result = iota
+	ResultSecure
+	ResultBogus
+)
+
+const (
+	TypeDNAME  dnsmessage.Type = 39
+	TypeDS     dnsmessage.Type = 43
+	TypeRRSIG  dnsmessage.Type = 46
+	TypeNSEC   dnsmessage.Type = 47
+	TypeDNSKEY dnsmessage.Type = 48
+	TypeNSEC3  dnsmessage.Type = 50
+)
+
+const (
+	maxChainDepth  = 32
+	maxKeyCacheTTL = 3600
+)
+
+var builtinTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+func Load(config *common.ConfigStruct) (*Anchors, error) {
+	if !config.DNSSEC.EnableValidation {
+		return nil, nil
+	}
+	anchors := &Anchors{
+		zones: make(map[string]*trustAnchor),
+		keys: &keyCache{
+			zones: make(map[string]*zoneKeys),
+			cuts:  make(map[string]*zoneKeys),
+		},
+	}
+	lines := builtinTrustAnchors
+	if config.DNSSEC.TrustAnchorFilePath != "" {
+		fileLines, err := readLines(config.DNSSEC.TrustAnchorFilePath)
+		if err != nil {
+			return nil, err
+		}
+		lines = fileLines
+	}
+	for _, line := range lines {
+		if err := anchors.addTrustAnchor(line); err != nil {
+			return nil, err
+		}
+	}
+	if anchors.zones["."] == nil {
+		return nil, errors.New("trust anchor of root zone is missing")
+	}
+	for zone, anchor := range anchors.zones {
+		logger.Info("Load Trust Anchor "+zone, len(anchor.dsRecords), "ds records", len(anchor.keys), "dnskey records")
+	}
+	return anchors, nil
+}
+
+func IsDNSSECType(rrType dnsmessage.Type) bool {
+	return rrType == TypeRRSIG || rrType == TypeNSEC || rrType == TypeNSEC3
+}
+
+func readLines(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func (anchors *Anchors) addTrustAnchor(line string) error {
+	if index := strings.Index(line, ";"); index >= 0 {
+		line = line[:index]
+	}
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(line))
+	if len(fields) == 0 {
+		return nil
+	}
+	typeIndex := -1
+	for i, field := range fields {
+		if upper := strings.ToUpper(field); upper == "DS" || upper == "DNSKEY" {
+			typeIndex = i
+			break
+		}
+	}
+	if typeIndex < 1 || len(fields) < typeIndex+5 {
+		return errors.New("trust anchor \"" + line + "\" is not correct")
+	}
+	owner := canonicalName(fields[0])
+	values := make([]int, 3)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[typeIndex+1+i], 10, 16)
+		if err != nil {
+			return errors.New("trust anchor \"" + line + "\" is not correct")
+		}
+		values[i] = int(value)
+	}
+	anchor := anchors.zones[owner]
+	if anchor == nil {
+		anchor = &trustAnchor{}
+		anchors.zones[owner] = anchor
+	}
+	data := strings.Join(fields[typeIndex+4:], "")
+	if strings.ToUpper(fields[typeIndex]) == "DS" {
+		digest, err := hex.DecodeString(data)
+		if err != nil {
+			return errors.New("trust anchor \"" + line + "\" is not correct")
+		}
+		anchor.dsRecords = append(anchor.dsRecords, &dsRecord{
+			keyTag:     uint16(values[0]),
+			algorithm:  uint8(values[1]),
+			digestType: uint8(values[2]),
+			digest:     digest,
+		})
+		return nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return errors.New("trust anchor \"" + line + "\" is not correct")
+	}
+	rdata := []byte{byte(values[0] >> 8), byte(values[0]), byte(values[1]), byte(values[2])}
+	key, err := parseDNSKey(append(rdata, publicKey...))
+	if err != nil {
+		return err
+	}
+	anchor.keys = append(anchor.keys, key)
+	return nil
+}
+
+func (anchors *Anchors) Validate(msg *dnsmessage.Message, query QueryFunc) (Result, error) {
+	v := &validator{query: query, anchors: anchors}
+	return v.validateMessage(msg)
+}
+
+func (v *validator) validateMessage(msg *dnsmessage.Message) (Result, error) {
+	if len(msg.Questions) != 1 {
+		return ResultInsecure, nil
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError {
+		return ResultInsecure, nil
+	}
+	question := msg.Questions[0]
+	result := ResultSecure
+	answerSets, err := groupRRSets(msg.Answers)
+	if err != nil {
+		return ResultBogus, err
+	}
+	wildcardSets := make([]*rrSet, 0)
+	for _, set := range answerSets {
+		if set.rrType == dnsmessage.TypeCNAME && len(set.sigs) == 0 && hasDNAME(answerSets, set.name) {
+			continue
+		}
+		setResult, err := v.validateRRSet(set)
+		if setResult == ResultBogus {
+			return ResultBogus, err
+		}
+		if setResult == ResultInsecure {
+			result = ResultInsecure
+		}
+		if setResult == ResultSecure && int(set.validSig.labels) < labelCount(set.name) {
+			wildcardSets = append(wildcardSets, set)
+		}
+	}
+	target := canonicalName(question.Name.String())
+	for i := 0; i < len(answerSets); i++ {
+		found := false
+		for _, set := range answerSets {
+			if set.name == target && set.rrType == dnsmessage.TypeCNAME && question.Type != dnsmessage.TypeCNAME {
+				if body, ok := set.records[0].Body.(*dnsmessage.CNAMEResource); ok {
+					target = canonicalName(body.CNAME.String())
+					found = true
+				}
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	answered := false
+	if msg.Header.RCode == dnsmessage.RCodeSuccess {
+		for _, set := range answerSets {
+			if set.name == target && (set.rrType == question.Type || question.Type == dnsmessage.TypeALL) {
+				answered = true
+			}
+		}
+	}
+	if answered && len(wildcardSets) == 0 {
+		return result, nil
+	}
+	authoritySets, err := groupRRSets(msg.Authorities)
+	if err != nil {
+		return ResultBogus, err
+	}
+	nsecs := make([]*nsecRecord, 0)
+	nsec3s := make([]*nsec3Record, 0)
+	for _, set := range authoritySets {
+		if set.rrType != dnsmessage.TypeSOA && set.rrType != TypeNSEC && set.rrType != TypeNSEC3 {
+			continue
+		}
+		setResult, err := v.validateRRSet(set)
+		if setResult == ResultBogus {
+			return ResultBogus, err
+		}
+		if setResult == ResultInsecure {
+			return ResultInsecure, nil
+		}
+		for _, res := range set.records {
+			body, ok := res.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				continue
+			}
+			if set.rrType == TypeNSEC {
+				record, err := parseNSEC(set.name, body.Data)
+				if err != nil {
+					return ResultBogus, err
+				}
+				nsecs = append(nsecs, record)
+			} else if set.rrType == TypeNSEC3 {
+				record, err := parseNSEC3(set.name, body.Data)
+				if err != nil {
+					return ResultBogus, err
+				}
+				nsec3s = append(nsec3s, record)
+			}
+		}
+	}
+	if len(wildcardSets) > 0 {
+		if !usableNSEC3(nsec3s) {
+			return ResultInsecure, nil
+		}
+		for _, set := range wildcardSets {
+			if !provesWildcardExpansion(set.name, int(set.validSig.labels), nsecs, nsec3s) {
+				return ResultBogus, errors.New("wildcard expansion of " + set.name + " " + set.rrType.String() + " is not proven")
+			}
+		}
+		if answered {
+			return result, nil
+		}
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		if v.isInsecure(target) {
+			return ResultInsecure, nil
+		}
+		return ResultBogus, errors.New("denial of existence for " + target + " " + question.Type.String() + " is missing")
+	}
+	if !usableNSEC3(nsec3s) {
+		return ResultInsecure, nil
+	}
+	if msg.Header.RCode == dnsmessage.RCodeNameError {
+		if !provesNameError(target, nsecs, nsec3s) {
+			return ResultBogus, errors.New("nxdomain for " + target + " is not proven")
+		}
+	} else if !provesNoData(target, question.Type, nsecs, nsec3s) {
+		return ResultBogus, errors.New("nodata for " + target + " " + question.Type.String() + " is not proven")
+	}
+	return result, nil
+}
+
+func hasDNAME(sets []*rrSet, name string) bool {
+	for _, set := range sets {
+		if set.rrType == TypeDNAME && set.name != name && isSubdomain(name, set.name) && len(set.sigs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func groupRRSets(resources []dnsmessage.Resource) ([]*rrSet, error) {
+	sets := make([]*rrSet, 0)
+	findSet := func(name string, rrType dnsmessage.Type, class dnsmessage.Class) *rrSet {
+		for _, set := range sets {
+			if set.name == name && set.rrType == rrType && set.class == class {
+				return set
+			}
+		}
+		set := &rrSet{name: name, rrType: rrType, class: class, ttl: ^uint32(0)}
+		sets = append(sets, set)
+		return set
+	}
+	sigs := make([]dnsmessage.Resource, 0)
+	for _, res := range resources {
+		switch res.Header.Type {
+		case dnsmessage.TypeOPT:
+		case TypeRRSIG:
+			sigs = append(sigs, res)
+		default:
+			set := findSet(canonicalName(res.Header.Name.String()), res.Header.Type, res.Header.Class)
+			set.records = append(set.records, res)
+			if res.Header.TTL < set.ttl {
+				set.ttl = res.Header.TTL
+			}
+		}
+	}
+	for _, res := range sigs {
+		body, ok := res.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		sig, err := parseRRSIG(body.Data)
+		if err != nil {
+			return nil, err
+		}
+		name := canonicalName(res.Header.Name.String())
+		for _, set := range sets {
+			if set.name == name && set.rrType == sig.typeCovered && set.class == res.Header.Class {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+	return sets, nil
+}
+
+func (v *validator) validateRRSet(set *rrSet) (Result, error) {
+	if len(set.sigs) == 0 {
+		if v.isInsecure(set.name) {
+			return ResultInsecure, nil
+		}
+		return ResultBogus, errors.New("rrset " + set.name + " " + set.rrType.String() + " is not signed")
+	}
+	return v.validateSignedRRSet(set)
+}
+
+func (v *validator) validateSignedRRSet(set *rrSet) (Result, error) {
+	err := errors.New("rrset " + set.name + " " + set.rrType.String() + " is not signed")
+	for _, sig := range set.sigs {
+		if !isSubdomain(set.name, sig.signerName) {
+			err = errors.New("signer " + sig.signerName + " of " + set.name + " is not correct")
+			continue
+		}
+		zone, zoneErr := v.zoneKeys(sig.signerName)
+		if zoneErr != nil {
+			err = zoneErr
+			continue
+		}
+		if zone.insecure {
+			return ResultInsecure, nil
+		}
+		for _, key := range zone.keys {
+			if key.keyTag != sig.keyTag || key.algorithm != sig.algorithm {
+				continue
+			}
+			if err = verifyRRSet(set, sig, key); err == nil {
+				set.validSig = sig
+				return ResultSecure, nil
+			}
+		}
+	}
+	return ResultBogus, err
+}
+
+func (v *validator) zoneKeys(zone string) (*zoneKeys, error) {
+	if cached := v.anchors.keys.load(v.anchors.keys.zones, zone); cached != nil {
+		return cached, nil
+	}
+	if v.depth >= maxChainDepth {
+		return nil, errors.New("chain of trust for " + zone + " is too long")
+	}
+	v.depth++
+	defer func() {
+		v.depth--
+	}()
+	var dsRecords []*dsRecord
+	var anchorKeys []*dnsKey
+	ttl := uint32(maxKeyCacheTTL)
+	if anchor := v.anchors.zones[zone]; anchor != nil {
+		dsRecords = anchor.dsRecords
+		anchorKeys = anchor.keys
+	} else if zone == "." {
+		return nil, errors.New("trust anchor of root zone is missing")
+	} else {
+		dsSet, err := v.fetchRRSet(zone, TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		if dsSet == nil {
+			if v.isInsecure(zone) {
+				return v.anchors.keys.store(v.anchors.keys.zones, zone, &zoneKeys{insecure: true}, ttl), nil
+			}
+			return nil, errors.New("ds of " + zone + " is missing")
+		}
+		result, err := v.validateSignedRRSet(dsSet)
+		if result == ResultBogus {
+			return nil, err
+		}
+		if result == ResultInsecure {
+			return v.anchors.keys.store(v.anchors.keys.zones, zone, &zoneKeys{insecure: true}, ttl), nil
+		}
+		if dsSet.ttl < ttl {
+			ttl = dsSet.ttl
+		}
+		for _, res := range dsSet.records {
+			if body, ok := res.Body.(*dnsmessage.UnknownResource); ok {
+				ds, err := parseDS(body.Data)
+				if err != nil {
+					return nil, err
+				}
+				dsRecords = append(dsRecords, ds)
+			}
+		}
+	}
+	supported := len(anchorKeys) > 0
+	for _, ds := range dsRecords {
+		if _, ok := digestHash(ds.digestType); ok && isSupportedAlgorithm(ds.algorithm) {
+			supported = true
+		}
+	}
+	if !supported {
+		return v.anchors.keys.store(v.anchors.keys.zones, zone, &zoneKeys{insecure: true}, ttl), nil
+	}
+	keySet, err := v.fetchRRSet(zone, TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if keySet == nil {
+		return nil, errors.New("dnskey of " + zone + " is missing")
+	}
+	zoneKeyList := make([]*dnsKey, 0, len(keySet.records))
+	trustedKeys := make([]*dnsKey, 0)
+	for _, res := range keySet.records {
+		body, ok := res.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		key, err := parseDNSKey(body.Data)
+		if err != nil {
+			return nil, err
+		}
+		if key.flags&dnsKeyFlagZone == 0 {
+			continue
+		}
+		zoneKeyList = append(zoneKeyList, key)
+		for _, ds := range dsRecords {
+			if ds.matches(zone, key) {
+				trustedKeys = append(trustedKeys, key)
+			}
+		}
+		for _, anchorKey := range anchorKeys {
+			if string(anchorKey.rdata) == string(key.rdata) {
+				trustedKeys = append(trustedKeys, key)
+			}
+		}
+	}
+	if len(trustedKeys) == 0 {
+		return nil, errors.New("no dnskey of " + zone + " matches its ds")
+	}
+	err = errors.New("dnskey of " + zone + " is not signed by a trusted key")
+	for _, sig := range keySet.sigs {
+		if sig.signerName != zone {
+			continue
+		}
+		for _, key := range trustedKeys {
+			if key.keyTag != sig.keyTag || key.algorithm != sig.algorithm {
+				continue
+			}
+			if err = verifyRRSet(keySet, sig, key); err == nil {
+				if keySet.ttl < ttl {
+					ttl = keySet.ttl
+				}
+				if common.NeedDebug() {
+					logger.Debug("DNSSEC Trust Zone", zone, len(zoneKeyList), "keys")
+				}
+				return v.anchors.keys.store(v.anchors.keys.zones, zone, &zoneKeys{keys: zoneKeyList}, ttl), nil
+			}
+		}
+	}
+	return nil, err
+}
+
+func (v *validator) fetchRRSet(name string, rrType dnsmessage.Type) (*rrSet, error) {
+	queryName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := v.query(queryName, rrType)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError {
+		return nil, errors.New("query " + name + " " + rrType.String() + " answered " + msg.Header.RCode.String())
+	}
+	sets, err := groupRRSets(msg.Answers)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if set.name == name && set.rrType == rrType {
+			return set, nil
+		}
+	}
+	return nil, nil
+}
+
+func (v *validator) isInsecure(name string) bool {
+	labels := nameLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		cut := ancestorName(name, i)
+		if cached := v.anchors.keys.load(v.anchors.keys.cuts, cut); cached != nil {
+			if cached.insecure {
+				return true
+			}
+			continue
+		}
+		insecure, err := v.checkCut(cut)
+		if err != nil {
+			if common.NeedDebug() {
+				logger.Debug("DNSSEC Check Delegation", cut, err)
+			}
+			return false
+		}
+		v.anchors.keys.store(v.anchors.keys.cuts, cut, &zoneKeys{insecure: insecure}, maxKeyCacheTTL)
+		if insecure {
+			logger.Info("DNSSEC Insecure Delegation", cut)
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) checkCut(cut string) (bool, error) {
+	if v.depth >= maxChainDepth {
+		return false, errors.New("chain of trust for " + cut + " is too long")
+	}
+	v.depth++
+	defer func() {
+		v.depth--
+	}()
+	queryName, err := dnsmessage.NewName(cut)
+	if err != nil {
+		return false, err
+	}
+	msg, err := v.query(queryName, TypeDS)
+	if err != nil {
+		return false, err
+	}
+	answerSets, err := groupRRSets(msg.Answers)
+	if err != nil {
+		return false, err
+	}
+	for _, set := range answerSets {
+		if set.name == cut && set.rrType == TypeDS {
+			result, err := v.validateSignedRRSet(set)
+			if result == ResultBogus {
+				return false, err
+			}
+			return result == ResultInsecure, nil
+		}
+	}
+	authoritySets, err := groupRRSets(msg.Authorities)
+	if err != nil {
+		return false, err
+	}
+	for _, set := range authoritySets {
+		if set.rrType != TypeNSEC && set.rrType != TypeNSEC3 {
+			continue
+		}
+		result, err := v.validateSignedRRSet(set)
+		if result == ResultBogus {
+			return false, err
+		}
+		if result == ResultInsecure {
+			return true, nil
+		}
+		for _, res := range set.records {
+			body, ok := res.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				continue
+			}
+			if set.rrType == TypeNSEC {
+				record, err := parseNSEC(set.name, body.Data)
+				if err != nil {
+					return false, err
+				}
+				if record.owner == cut {
+					return isInsecureDelegation(record.types), nil
+				}
+				continue
+			}
+			record, err := parseNSEC3(set.name, body.Data)
+			if err != nil {
+				return false, err
+			}
+			if !usableNSEC3([]*nsec3Record{record}) {
+				return true, nil
+			}
+			if record.matches(cut) {
+				return isInsecureDelegation(record.types), nil
+			}
+			if record.flags&nsec3FlagOptOut != 0 && record.covers(cut) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func isInsecureDelegation(types []byte) bool {
+	return isDelegation(types) && !hasType(types, TypeDS)
+}
+
+func isDelegation(types []byte) bool {
+	return hasType(types, dnsmessage.TypeNS) && !hasType(types, dnsmessage.TypeSOA)
+}
+
+func (cache *keyCache) load(entries map[string]*zoneKeys, name string) *zoneKeys {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := entries[name]
+	if entry == nil || entry.expireAt < time.Now().UnixNano() {
+		return nil
+	}
+	return entry
+}
+
+func (cache *keyCache) store(entries map[string]*zoneKeys, name string, entry *zoneKeys, ttl uint32) *zoneKeys {
+	entry.expireAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entries[name] = entry
+	return entry
+}
@@ -0,0 +1,347 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	testInception  = 1704067200
+	testExpiration = testInception + 0x7FFFFFFF
+	testExpired    = testInception + 86400
+)
+
+type testZone struct {
+	name   string
+	key    ed25519.PrivateKey
+	dnskey []byte
+	tag    uint16
+}
+
+type testServer map[string]*dnsmessage.Message
+
+func newTestZone(name string, seed byte) *testZone {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	dnskey := append([]byte{1, 1, 3, AlgorithmED25519}, key.Public().(ed25519.PublicKey)...)
+	return &testZone{name: name, key: key, dnskey: dnskey, tag: keyTag(dnskey)}
+}
+
+func testRR(name string, rrType dnsmessage.Type, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: rrType, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: rrType, Data: data},
+	}
+}
+
+func testA(name string, last byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}},
+	}
+}
+
+func testBitmap(types ...dnsmessage.Type) []byte {
+	bitmap := make([]byte, 32)
+	length := 0
+	for _, rrType := range types {
+		bitmap[rrType/8] |= 0x80 >> (rrType % 8)
+		if int(rrType/8)+1 > length {
+			length = int(rrType/8) + 1
+		}
+	}
+	return append([]byte{0, byte(length)}, bitmap[:length]...)
+}
+
+func testNSEC(owner string, next string, types ...dnsmessage.Type) dnsmessage.Resource {
+	return testRR(owner, TypeNSEC, append(nameToWire(next), testBitmap(types...)...))
+}
+
+func testNSEC3Hash(name string) []byte {
+	hash := sha1.Sum(nameToWire(name))
+	return hash[:]
+}
+
+func testNSEC3Chain(zone string, names []string, types map[string][]dnsmessage.Type) []dnsmessage.Resource {
+	hashes := make([][]byte, 0, len(names))
+	owners := make(map[string]string)
+	for _, name := range names {
+		hash := testNSEC3Hash(name)
+		hashes = append(hashes, hash)
+		owners[string(hash)] = name
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i], hashes[j]) < 0
+	})
+	records := make([]dnsmessage.Resource, 0, len(hashes))
+	for i, hash := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		data := []byte{nsec3HashSHA1, 0, 0, 0, 0, byte(len(next))}
+		data = append(data, next...)
+		data = append(data, testBitmap(types[owners[string(hash)]]...)...)
+		records = append(records, testRR(strings.ToLower(nsec3Encoding.EncodeToString(hash))+"."+zone, TypeNSEC3, data))
+	}
+	return records
+}
+
+func (zone *testZone) sign(records []dnsmessage.Resource, signedOwner string, expiration uint32, corrupt bool) dnsmessage.Resource {
+	header := records[0].Header
+	owner := strings.ToLower(header.Name.String())
+	if signedOwner == "" {
+		signedOwner = owner
+	}
+	rdata := make([]byte, 18)
+	binary.BigEndian.PutUint16(rdata[0:2], uint16(header.Type))
+	rdata[2] = AlgorithmED25519
+	rdata[3] = byte(labelCount(signedOwner))
+	binary.BigEndian.PutUint32(rdata[4:8], header.TTL)
+	binary.BigEndian.PutUint32(rdata[8:12], expiration)
+	binary.BigEndian.PutUint32(rdata[12:16], testInception)
+	binary.BigEndian.PutUint16(rdata[16:18], zone.tag)
+	rdata = append(rdata, nameToWire(zone.name)...)
+	rdatas := make([][]byte, 0, len(records))
+	for _, res := range records {
+		switch body := res.Body.(type) {
+		case *dnsmessage.AResource:
+			rdatas = append(rdatas, body.A[:])
+		case *dnsmessage.UnknownResource:
+			rdatas = append(rdatas, body.Data)
+		}
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+	data := append([]byte{}, rdata...)
+	for _, recordData := range rdatas {
+		data = append(data, nameToWire(signedOwner)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(header.Type))
+		data = binary.BigEndian.AppendUint16(data, uint16(dnsmessage.ClassINET))
+		data = binary.BigEndian.AppendUint32(data, header.TTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(recordData)))
+		data = append(data, recordData...)
+	}
+	signature := ed25519.Sign(zone.key, data)
+	if corrupt {
+		signature[0] ^= 0xFF
+	}
+	return testRR(owner, TypeRRSIG, append(rdata, signature...))
+}
+
+func (zone *testZone) signed(records ...dnsmessage.Resource) []dnsmessage.Resource {
+	return append(records, zone.sign(records, "", testExpiration, false))
+}
+
+func (zone *testZone) signedEach(records []dnsmessage.Resource) []dnsmessage.Resource {
+	signedRecords := make([]dnsmessage.Resource, 0, len(records)*2)
+	for _, res := range records {
+		signedRecords = append(signedRecords, zone.signed(res)...)
+	}
+	return signedRecords
+}
+
+func testMessage(name string, qType dnsmessage.Type, rCode dnsmessage.RCode, answers []dnsmessage.Resource, authorities []dnsmessage.Resource) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: rCode},
+		Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qType, Class: dnsmessage.ClassINET}},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	msgBytes, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	wireMsg := &dnsmessage.Message{}
+	if err := wireMsg.Unpack(msgBytes); err != nil {
+		panic(err)
+	}
+	return wireMsg
+}
+
+func newTestValidator(t *testing.T, zone *testZone, server testServer) *Anchors {
+	anchors := &Anchors{
+		zones: make(map[string]*trustAnchor),
+		keys: &keyCache{
+			zones: make(map[string]*zoneKeys),
+			cuts:  make(map[string]*zoneKeys),
+		},
+	}
+	if err := anchors.addTrustAnchor(zone.name + " IN DNSKEY 257 3 15 " + base64.StdEncoding.EncodeToString(zone.dnskey[4:])); err != nil {
+		t.Fatal(err)
+	}
+	keyRR := testRR(zone.name, TypeDNSKEY, zone.dnskey)
+	server[zone.name+"|"+TypeDNSKEY.String()] = testMessage(zone.name, TypeDNSKEY, dnsmessage.RCodeSuccess, zone.signed(keyRR), nil)
+	return anchors
+}
+
+func (server testServer) query(name dnsmessage.Name, qType dnsmessage.Type) (*dnsmessage.Message, error) {
+	if msg, ok := server[name.String()+"|"+qType.String()]; ok {
+		return msg, nil
+	}
+	return testMessage(name.String(), qType, dnsmessage.RCodeSuccess, nil, nil), nil
+}
+
+func TestValidateMessage(t *testing.T) {
+	zone := newTestZone("example.", 1)
+	wwwA := testA("www.example.", 1)
+	wildcardA := testA("a.example.", 2)
+	wildcardNSEC3 := testNSEC3Chain("example.", []string{"example.", "*.example.", "www.example."}, map[string][]dnsmessage.Type{
+		"example.":     {dnsmessage.TypeNS, dnsmessage.TypeSOA, TypeRRSIG, TypeDNSKEY},
+		"*.example.":   {dnsmessage.TypeA, TypeRRSIG},
+		"www.example.": {dnsmessage.TypeA, TypeRRSIG},
+	})
+	nxNSEC3 := testNSEC3Chain("example.", []string{"example.", "www.example."}, map[string][]dnsmessage.Type{
+		"example.":     {dnsmessage.TypeNS, dnsmessage.TypeSOA, TypeRRSIG, TypeDNSKEY},
+		"www.example.": {dnsmessage.TypeA, TypeRRSIG},
+	})
+	delegationNSEC := testNSEC("sub.example.", "www.example.", dnsmessage.TypeNS, TypeRRSIG, TypeNSEC)
+	delegationNSEC3 := testNSEC3Chain("example.", []string{"example.", "sub.example.", "www.example."}, map[string][]dnsmessage.Type{
+		"example.":     {dnsmessage.TypeNS, dnsmessage.TypeSOA, TypeRRSIG, TypeDNSKEY},
+		"sub.example.": {dnsmessage.TypeNS},
+		"www.example.": {dnsmessage.TypeA, TypeRRSIG},
+	})
+	cases := []struct {
+		name   string
+		msg    *dnsmessage.Message
+		result Result
+	}{
+		{
+			name:   "secure",
+			msg:    testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, zone.signed(wwwA), nil),
+			result: ResultSecure,
+		},
+		{
+			name:   "bogus signature",
+			msg:    testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Resource{wwwA, zone.sign([]dnsmessage.Resource{wwwA}, "", testExpiration, true)}, nil),
+			result: ResultBogus,
+		},
+		{
+			name:   "expired signature",
+			msg:    testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Resource{wwwA, zone.sign([]dnsmessage.Resource{wwwA}, "", testExpired, false)}, nil),
+			result: ResultBogus,
+		},
+		{
+			name:   "unsigned answer",
+			msg:    testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Resource{wwwA}, nil),
+			result: ResultBogus,
+		},
+		{
+			name: "nsec nxdomain",
+			msg: testMessage("nx.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, zone.signed(
+				testNSEC("example.", "www.example.", dnsmessage.TypeNS, dnsmessage.TypeSOA, TypeRRSIG, TypeNSEC, TypeDNSKEY),
+			)),
+			result: ResultSecure,
+		},
+		{
+			name: "nsec nxdomain without wildcard proof",
+			msg: testMessage("nx.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, zone.signed(
+				testNSEC("mx.example.", "www.example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC),
+			)),
+			result: ResultBogus,
+		},
+		{
+			name: "nsec nodata",
+			msg: testMessage("www.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, zone.signed(
+				testNSEC("www.example.", "example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC),
+			)),
+			result: ResultSecure,
+		},
+		{
+			name: "nsec nodata for existing type",
+			msg: testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, zone.signed(
+				testNSEC("www.example.", "example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC),
+			)),
+			result: ResultBogus,
+		},
+		{
+			name:   "nsec nodata from ancestor delegation",
+			msg:    testMessage("sub.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, zone.signed(delegationNSEC)),
+			result: ResultBogus,
+		},
+		{
+			name:   "nsec empty non-terminal below delegation",
+			msg:    testMessage("a.sub.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, zone.signed(testNSEC("sub.example.", "b.a.sub.example.", dnsmessage.TypeNS, TypeRRSIG, TypeNSEC))),
+			result: ResultBogus,
+		},
+		{
+			name:   "nsec nodata for ds at delegation",
+			msg:    testMessage("sub.example.", TypeDS, dnsmessage.RCodeSuccess, nil, zone.signed(delegationNSEC)),
+			result: ResultSecure,
+		},
+		{
+			name:   "nsec3 nodata from ancestor delegation",
+			msg:    testMessage("sub.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, zone.signedEach(delegationNSEC3)),
+			result: ResultBogus,
+		},
+		{
+			name:   "nsec3 nodata for ds at delegation",
+			msg:    testMessage("sub.example.", TypeDS, dnsmessage.RCodeSuccess, nil, zone.signedEach(delegationNSEC3)),
+			result: ResultSecure,
+		},
+		{
+			name:   "nsec3 nxdomain",
+			msg:    testMessage("nx.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, zone.signedEach(nxNSEC3)),
+			result: ResultSecure,
+		},
+		{
+			name:   "nsec3 nodata",
+			msg:    testMessage("www.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, zone.signedEach(nxNSEC3)),
+			result: ResultSecure,
+		},
+		{
+			name:   "missing denial",
+			msg:    testMessage("nx.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nil),
+			result: ResultBogus,
+		},
+		{
+			name:   "insecure delegation",
+			msg:    testMessage("www.sub.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Resource{testA("www.sub.example.", 3)}, nil),
+			result: ResultInsecure,
+		},
+		{
+			name: "nsec wildcard expansion",
+			msg: testMessage("a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{wildcardA, zone.sign([]dnsmessage.Resource{wildcardA}, "*.example.", testExpiration, false)},
+				zone.signed(testNSEC("*.example.", "www.example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC))),
+			result: ResultSecure,
+		},
+		{
+			name: "nsec3 wildcard expansion",
+			msg: testMessage("a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{wildcardA, zone.sign([]dnsmessage.Resource{wildcardA}, "*.example.", testExpiration, false)},
+				zone.signedEach(wildcardNSEC3)),
+			result: ResultSecure,
+		},
+		{
+			name: "wildcard expansion without denial",
+			msg: testMessage("a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{wildcardA, zone.sign([]dnsmessage.Resource{wildcardA}, "*.example.", testExpiration, false)}, nil),
+			result: ResultBogus,
+		},
+		{
+			name: "wildcard expansion over existing name",
+			msg: testMessage("www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{wwwA, zone.sign([]dnsmessage.Resource{wwwA}, "*.example.", testExpiration, false)},
+				zone.signed(testNSEC("*.example.", "www.example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC))),
+			result: ResultBogus,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := testServer{}
+			server["sub.example.|"+TypeDS.String()] = testMessage("sub.example.", TypeDS, dnsmessage.RCodeSuccess, nil, zone.signed(
+				testNSEC("sub.example.", "www.example.", dnsmessage.TypeNS, TypeRRSIG, TypeNSEC),
+			))
+			anchors := newTestValidator(t, zone, server)
+			result, err := anchors.Validate(c.msg, server.query)
+			if result != c.result {
+				t.Fatalf("got result %d (%v), want %d", result, err, c.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package dnssec
+
+import (
+	"errors"
+	"strings"
+)
+
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+func labelCount(name string) int {
+	labels := nameLabels(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+func parentName(name string) string {
+	index := strings.Index(name, ".")
+	if index < 0 || index == len(name)-1 {
+		return "."
+	}
+	return name[index+1:]
+}
+
+func ancestorName(name string, numOfLabels int) string {
+	labels := nameLabels(name)
+	if numOfLabels <= 0 {
+		return "."
+	}
+	if numOfLabels >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-numOfLabels:], ".") + "."
+}
+
+func isSubdomain(child string, parent string) bool {
+	return parent == "." || child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+func commonAncestor(a string, b string) string {
+	aLabels := nameLabels(a)
+	bLabels := nameLabels(b)
+	count := 0
+	for count < len(aLabels) && count < len(bLabels) && aLabels[len(aLabels)-1-count] == bLabels[len(bLabels)-1-count] {
+		count++
+	}
+	return ancestorName(a, count)
+}
+
+func compareNames(a string, b string) int {
+	aLabels := nameLabels(a)
+	bLabels := nameLabels(b)
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if c := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+func nameToWire(name string) []byte {
+	wire := make([]byte, 0, len(name)+1)
+	for _, label := range nameLabels(name) {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	return append(wire, 0)
+}
+
+func wireToName(data []byte, offset int) (string, int, error) {
+	var builder strings.Builder
+	for {
+		if offset >= len(data) {
+			return "", 0, errors.New("domain name is truncated")
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(data) {
+			return "", 0, errors.New("domain name is not correct")
+		}
+		builder.Write(data[offset : offset+length])
+		builder.WriteByte('.')
+		offset += length
+	}
+	if builder.Len() == 0 {
+		return ".", offset, nil
+	}
+	return strings.ToLower(builder.String()), offset, nil
+}
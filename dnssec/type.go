@@ -0,0 +1,93 @@
+package dnssec
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"sync"
+)
+
+type Result int
+
+type QueryFunc func(name dnsmessage.Name, qType dnsmessage.Type) (*dnsmessage.Message, error)
+
+type validator struct {
+	query   QueryFunc
+	anchors *Anchors
+	depth   int
+}
+
+type Anchors struct {
+	zones map[string]*trustAnchor
+	keys  *keyCache
+}
+
+type rrSet struct {
+	name     string
+	rrType   dnsmessage.Type
+	class    dnsmessage.Class
+	ttl      uint32
+	records  []dnsmessage.Resource
+	sigs     []*rrsig
+	validSig *rrsig
+}
+
+type rrsig struct {
+	typeCovered dnsmessage.Type
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signerName  string
+	signature   []byte
+}
+
+type dnsKey struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+	keyTag    uint16
+}
+
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+type nsecRecord struct {
+	owner string
+	next  string
+	types []byte
+}
+
+type nsec3Record struct {
+	owner      string
+	hash       []byte
+	algorithm  uint8
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	nextHash   []byte
+	types      []byte
+}
+
+type trustAnchor struct {
+	dsRecords []*dsRecord
+	keys      []*dnsKey
+}
+
+type zoneKeys struct {
+	keys     []*dnsKey
+	insecure bool
+	expireAt int64
+}
+
+type keyCache struct {
+	mutex sync.Mutex
+	zones map[string]*zoneKeys
+	cuts  map[string]*zoneKeys
+}
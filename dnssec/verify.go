@@ -0,0 +1,334 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	AlgorithmRSASHA1          = 5
+	AlgorithmRSASHA1NSEC3SHA1 = 7
+	AlgorithmRSASHA256        = 8
+	AlgorithmRSASHA512        = 10
+	AlgorithmECDSAP256SHA256  = 13
+	AlgorithmECDSAP384SHA384  = 14
+	AlgorithmED25519          = 15
+
+	DigestSHA1   = 1
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+
+	dnsKeyFlagZone = 0x0100
+)
+
+func isSupportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3SHA1, AlgorithmRSASHA256, AlgorithmRSASHA512,
+		AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+func digestHash(digestType uint8) (crypto.Hash, bool) {
+	switch digestType {
+	case DigestSHA1:
+		return crypto.SHA1, true
+	case DigestSHA256:
+		return crypto.SHA256, true
+	case DigestSHA384:
+		return crypto.SHA384, true
+	}
+	return 0, false
+}
+
+func parseRRSIG(data []byte) (*rrsig, error) {
+	if len(data) < 18 {
+		return nil, errors.New("rrsig record is truncated")
+	}
+	sig := &rrsig{
+		typeCovered: dnsmessage.Type(binary.BigEndian.Uint16(data[0:2])),
+		algorithm:   data[2],
+		labels:      data[3],
+		originalTTL: binary.BigEndian.Uint32(data[4:8]),
+		expiration:  binary.BigEndian.Uint32(data[8:12]),
+		inception:   binary.BigEndian.Uint32(data[12:16]),
+		keyTag:      binary.BigEndian.Uint16(data[16:18]),
+	}
+	signerName, offset, err := wireToName(data, 18)
+	if err != nil {
+		return nil, err
+	}
+	sig.signerName = signerName
+	sig.signature = data[offset:]
+	return sig, nil
+}
+
+func parseDNSKey(data []byte) (*dnsKey, error) {
+	if len(data) < 4 {
+		return nil, errors.New("dnskey record is truncated")
+	}
+	return &dnsKey{
+		flags:     binary.BigEndian.Uint16(data[0:2]),
+		protocol:  data[2],
+		algorithm: data[3],
+		publicKey: data[4:],
+		rdata:     data,
+		keyTag:    keyTag(data),
+	}, nil
+}
+
+func parseDS(data []byte) (*dsRecord, error) {
+	if len(data) < 4 {
+		return nil, errors.New("ds record is truncated")
+	}
+	return &dsRecord{
+		keyTag:     binary.BigEndian.Uint16(data[0:2]),
+		algorithm:  data[2],
+		digestType: data[3],
+		digest:     data[4:],
+	}, nil
+}
+
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+func (ds *dsRecord) matches(owner string, key *dnsKey) bool {
+	if ds.keyTag != key.keyTag || ds.algorithm != key.algorithm || key.flags&dnsKeyFlagZone == 0 {
+		return false
+	}
+	hash, ok := digestHash(ds.digestType)
+	if !ok {
+		return false
+	}
+	hasher := hash.New()
+	hasher.Write(nameToWire(owner))
+	hasher.Write(key.rdata)
+	return bytes.Equal(hasher.Sum(nil), ds.digest)
+}
+
+func lowerName(name dnsmessage.Name) dnsmessage.Name {
+	for i := 0; i < int(name.Length); i++ {
+		if name.Data[i] >= 'A' && name.Data[i] <= 'Z' {
+			name.Data[i] += 'a' - 'A'
+		}
+	}
+	return name
+}
+
+func canonicalRData(res *dnsmessage.Resource) ([]byte, error) {
+	if body, ok := res.Body.(*dnsmessage.UnknownResource); ok {
+		return body.Data, nil
+	}
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{})
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Class: res.Header.Class}
+	var err error
+	switch body := res.Body.(type) {
+	case *dnsmessage.AResource:
+		err = builder.AResource(header, *body)
+	case *dnsmessage.AAAAResource:
+		err = builder.AAAAResource(header, *body)
+	case *dnsmessage.NSResource:
+		err = builder.NSResource(header, dnsmessage.NSResource{NS: lowerName(body.NS)})
+	case *dnsmessage.CNAMEResource:
+		err = builder.CNAMEResource(header, dnsmessage.CNAMEResource{CNAME: lowerName(body.CNAME)})
+	case *dnsmessage.PTRResource:
+		err = builder.PTRResource(header, dnsmessage.PTRResource{PTR: lowerName(body.PTR)})
+	case *dnsmessage.MXResource:
+		err = builder.MXResource(header, dnsmessage.MXResource{Pref: body.Pref, MX: lowerName(body.MX)})
+	case *dnsmessage.SOAResource:
+		soa := *body
+		soa.NS = lowerName(soa.NS)
+		soa.MBox = lowerName(soa.MBox)
+		err = builder.SOAResource(header, soa)
+	case *dnsmessage.SRVResource:
+		srv := *body
+		srv.Target = lowerName(srv.Target)
+		err = builder.SRVResource(header, srv)
+	case *dnsmessage.TXTResource:
+		err = builder.TXTResource(header, *body)
+	case *dnsmessage.SVCBResource:
+		err = builder.SVCBResource(header, *body)
+	case *dnsmessage.HTTPSResource:
+		err = builder.HTTPSResource(header, *body)
+	default:
+		return nil, errors.New("record type " + res.Header.Type.String() + " can not be canonicalized")
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgBytes, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return msgBytes[12+1+10:], nil
+}
+
+func signedData(set *rrSet, sig *rrsig) ([]byte, error) {
+	owner := set.name
+	if numOfLabels := labelCount(owner); int(sig.labels) < numOfLabels {
+		owner = "*." + ancestorName(owner, int(sig.labels))
+		if owner == "*.." {
+			owner = "*."
+		}
+	} else if int(sig.labels) > numOfLabels {
+		return nil, errors.New("rrsig labels of " + set.name + " is not correct")
+	}
+	rdatas := make([][]byte, 0, len(set.records))
+	for i := range set.records {
+		rdata, err := canonicalRData(&set.records[i])
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+	data := make([]byte, 18, 512)
+	binary.BigEndian.PutUint16(data[0:2], uint16(sig.typeCovered))
+	data[2] = sig.algorithm
+	data[3] = sig.labels
+	binary.BigEndian.PutUint32(data[4:8], sig.originalTTL)
+	binary.BigEndian.PutUint32(data[8:12], sig.expiration)
+	binary.BigEndian.PutUint32(data[12:16], sig.inception)
+	binary.BigEndian.PutUint16(data[16:18], sig.keyTag)
+	data = append(data, nameToWire(sig.signerName)...)
+	ownerWire := nameToWire(owner)
+	rrHeader := make([]byte, 10)
+	binary.BigEndian.PutUint16(rrHeader[0:2], uint16(set.rrType))
+	binary.BigEndian.PutUint16(rrHeader[2:4], uint16(set.class))
+	binary.BigEndian.PutUint32(rrHeader[4:8], sig.originalTTL)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		binary.BigEndian.PutUint16(rrHeader[8:10], uint16(len(rdata)))
+		data = append(data, ownerWire...)
+		data = append(data, rrHeader...)
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+func verifyRRSet(set *rrSet, sig *rrsig, key *dnsKey) error {
+	if sig.typeCovered != set.rrType {
+		return errors.New("rrsig type of " + set.name + " is not match")
+	}
+	if key.protocol != 3 || key.flags&dnsKeyFlagZone == 0 {
+		return errors.New("dnskey " + strconv.Itoa(int(key.keyTag)) + " of " + sig.signerName + " is not a zone key")
+	}
+	now := uint32(time.Now().Unix())
+	if int32(now-sig.inception) < 0 {
+		return errors.New("rrsig of " + set.name + " " + set.rrType.String() + " is not yet valid")
+	}
+	if int32(sig.expiration-now) < 0 {
+		return errors.New("rrsig of " + set.name + " " + set.rrType.String() + " has expired")
+	}
+	data, err := signedData(set, sig)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(sig.algorithm, key.publicKey, data, sig.signature); err != nil {
+		return errors.New("rrsig of " + set.name + " " + set.rrType.String() + " is not valid: " + err.Error())
+	}
+	return nil
+}
+
+func verifySignature(algorithm uint8, publicKey []byte, data []byte, signature []byte) error {
+	switch algorithm {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3SHA1, AlgorithmRSASHA256, AlgorithmRSASHA512:
+		hash := crypto.SHA1
+		if algorithm == AlgorithmRSASHA256 {
+			hash = crypto.SHA256
+		} else if algorithm == AlgorithmRSASHA512 {
+			hash = crypto.SHA512
+		}
+		rsaKey, err := parseRSAKey(publicKey)
+		if err != nil {
+			return err
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+		return rsa.VerifyPKCS1v15(rsaKey, hash, hasher.Sum(nil), signature)
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if algorithm == AlgorithmECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		size := curve.Params().BitSize / 8
+		if len(publicKey) != size*2 || len(signature) != size*2 {
+			return errors.New("ecdsa key or signature length is not correct")
+		}
+		ecdsaKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+		if !ecdsa.Verify(ecdsaKey, hasher.Sum(nil), new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("ecdsa verification failed")
+		}
+		return nil
+	case AlgorithmED25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("ed25519 key length is not correct")
+		}
+		if !ed25519.Verify(publicKey, data, signature) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	}
+	return errors.New("algorithm " + strconv.Itoa(int(algorithm)) + " is not supported")
+}
+
+func parseRSAKey(publicKey []byte) (*rsa.PublicKey, error) {
+	if len(publicKey) < 3 {
+		return nil, errors.New("rsa key is truncated")
+	}
+	exponentLen := int(publicKey[0])
+	offset := 1
+	if exponentLen == 0 {
+		exponentLen = int(binary.BigEndian.Uint16(publicKey[1:3]))
+		offset = 3
+	}
+	if exponentLen > 4 || offset+exponentLen >= len(publicKey) {
+		return nil, errors.New("rsa key exponent is not supported")
+	}
+	exponent := 0
+	for _, b := range publicKey[offset : offset+exponentLen] {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(publicKey[offset+exponentLen:]),
+		E: exponent,
+	}, nil
+}
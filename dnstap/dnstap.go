@@ -0,0 +1,301 @@
+package dnstap
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"accdns/metrics"
+	"accdns/network"
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MessageClientQuery       MessageType = 5
+	MessageClientResponse    MessageType = 6
+	MessageForwarderQuery    MessageType = 7
+	MessageForwarderResponse MessageType = 8
+)
+
+const (
+	protocolUDP = 1
+	protocolTCP = 2
+)
+
+const reconnectInterval = 5 * time.Second
+const handshakeTimeout = 5 * time.Second
+
+var version = []byte("AccDNS")
+var identity []byte
+
+var frameChan chan []byte
+var stopChan chan bool
+var doneChan chan bool
+var closeMutex sync.RWMutex
+var closed bool
+var dropped uint64
+
+func Init() error {
+	if !common.Config.Dnstap.EnableDnstap {
+		return nil
+	}
+	if common.Config.Dnstap.SocketPath == "" && common.Config.Dnstap.FilePath == "" {
+		return errors.New("dnstap socket path and file path are both empty")
+	}
+	if common.Config.Dnstap.BufferSize < 1 {
+		return errors.New("dnstap buffer size " + strconv.Itoa(common.Config.Dnstap.BufferSize) + " is not correct")
+	}
+	identity = []byte(common.Config.Dnstap.Identity)
+	if len(identity) == 0 {
+		if hostname, err := os.Hostname(); err == nil {
+			identity = []byte(hostname)
+		}
+	}
+	var file *os.File
+	if common.Config.Dnstap.SocketPath == "" {
+		var err error
+		file, err = os.OpenFile(common.Config.Dnstap.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	frameChan = make(chan []byte, common.Config.Dnstap.BufferSize)
+	stopChan = make(chan bool)
+	doneChan = make(chan bool)
+	metrics.RegisterCounterFunc("accdns_dnstap_dropped_total", "dnstap messages dropped because the buffer was full.", func() float64 {
+		return float64(atomic.LoadUint64(&dropped))
+	})
+	if file != nil {
+		go fileLoop(file)
+	} else {
+		go socketLoop(common.Config.Dnstap.SocketPath)
+	}
+	return nil
+}
+
+func Enabled() bool {
+	return frameChan != nil
+}
+
+func Close() {
+	if frameChan == nil {
+		return
+	}
+	closeMutex.Lock()
+	if closed {
+		closeMutex.Unlock()
+		return
+	}
+	closed = true
+	close(frameChan)
+	close(stopChan)
+	closeMutex.Unlock()
+	select {
+	case <-doneChan:
+	case <-time.After(handshakeTimeout):
+		logger.Warning("Close dnstap Output", "timed out flushing buffered messages")
+	}
+}
+
+func ClientQuery(clientAddr net.Addr, serverAddr net.Addr, queryBytes []byte, queryTime time.Time) {
+	if frameChan == nil {
+		return
+	}
+	msg := &message{
+		msgType:      MessageClientQuery,
+		queryTime:    queryTime,
+		queryMessage: queryBytes,
+	}
+	msg.queryAddr, msg.queryPort, msg.protocol = addrInfo(clientAddr)
+	msg.responseAddr, msg.responsePort, _ = addrInfo(serverAddr)
+	emit(msg)
+}
+
+func ClientResponse(clientAddr net.Addr, serverAddr net.Addr, respBytes []byte, queryTime time.Time) {
+	if frameChan == nil {
+		return
+	}
+	msg := &message{
+		msgType:         MessageClientResponse,
+		queryTime:       queryTime,
+		responseTime:    time.Now(),
+		responseMessage: respBytes,
+	}
+	msg.queryAddr, msg.queryPort, msg.protocol = addrInfo(clientAddr)
+	msg.responseAddr, msg.responsePort, _ = addrInfo(serverAddr)
+	emit(msg)
+}
+
+func ForwarderQuery(upstreamAddr *network.SocketAddr, queryBytes []byte, queryTime time.Time) {
+	if frameChan == nil {
+		return
+	}
+	msg := &message{
+		msgType:      MessageForwarderQuery,
+		queryTime:    queryTime,
+		queryMessage: queryBytes,
+	}
+	msg.responseAddr, msg.responsePort, msg.protocol = upstreamInfo(upstreamAddr)
+	emit(msg)
+}
+
+func ForwarderResponse(upstreamAddr *network.SocketAddr, respBytes []byte, queryTime time.Time) {
+	if frameChan == nil {
+		return
+	}
+	msg := &message{
+		msgType:         MessageForwarderResponse,
+		queryTime:       queryTime,
+		responseTime:    time.Now(),
+		responseMessage: respBytes,
+	}
+	msg.responseAddr, msg.responsePort, msg.protocol = upstreamInfo(upstreamAddr)
+	emit(msg)
+}
+
+func emit(msg *message) {
+	frame := msg.encode(identity, version)
+	closeMutex.RLock()
+	defer closeMutex.RUnlock()
+	if closed {
+		return
+	}
+	select {
+	case frameChan <- frame:
+	default:
+		atomic.AddUint64(&dropped, 1)
+	}
+}
+
+func addrInfo(addr net.Addr) (net.IP, int, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, protocolUDP
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, protocolTCP
+	}
+	return nil, 0, protocolUDP
+}
+
+func upstreamInfo(upstreamAddr *network.SocketAddr) (net.IP, int, int) {
+	if upstreamAddr.UDPAddr != nil {
+		return addrInfo(upstreamAddr.UDPAddr)
+	}
+	if upstreamAddr.TCPAddr != nil {
+		return addrInfo(upstreamAddr.TCPAddr)
+	}
+	return nil, 0, protocolUDP
+}
+
+func fileLoop(file *os.File) {
+	defer close(doneChan)
+	defer func() {
+		if err := file.Close(); err != nil {
+			logger.Warning("Close dnstap File", err)
+		}
+	}()
+	writer := bufio.NewWriter(file)
+	if err := writeControlFrame(writer, controlStart, true); err != nil {
+		logger.Error("Write dnstap File", err)
+		return
+	}
+	if err := writeFrames(writer); err != nil {
+		logger.Error("Write dnstap File", err)
+		return
+	}
+	if err := writeControlFrame(writer, controlStop, false); err != nil {
+		logger.Warning("Write dnstap File", err)
+	}
+	if err := writer.Flush(); err != nil {
+		logger.Warning("Write dnstap File", err)
+	}
+}
+
+func socketLoop(socketPath string) {
+	defer close(doneChan)
+	for {
+		conn, err := connect(socketPath)
+		if err != nil {
+			logger.Warning("Connect dnstap Collector", socketPath, err)
+			select {
+			case <-time.After(reconnectInterval):
+				continue
+			case <-stopChan:
+				return
+			}
+		}
+		logger.Info("Connect dnstap Collector", "connected to", socketPath)
+		writer := bufio.NewWriter(conn)
+		if err := writeFrames(writer); err != nil {
+			logger.Warning("Write dnstap Frame", socketPath, err)
+			_ = conn.Close()
+			continue
+		}
+		disconnect(conn, writer)
+		return
+	}
+}
+
+func connect(socketPath string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", socketPath, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeControlFrame(conn, controlReady, true); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	controlType, err := readControlFrame(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if controlType != controlAccept {
+		_ = conn.Close()
+		return nil, errors.New("dnstap collector did not accept the connection")
+	}
+	if err := writeControlFrame(conn, controlStart, true); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func disconnect(conn net.Conn, writer *bufio.Writer) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeControlFrame(writer, controlStop, false); err != nil {
+		logger.Warning("Write dnstap Frame", err)
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		logger.Warning("Write dnstap Frame", err)
+		return
+	}
+	if controlType, err := readControlFrame(conn); err != nil || controlType != controlFinish {
+		logger.Warning("Disconnect dnstap Collector", "collector did not finish", err)
+	}
+}
+
+func writeFrames(writer *bufio.Writer) error {
+	for frame := range frameChan {
+		if err := writeDataFrame(writer, frame); err != nil {
+			return err
+		}
+		if len(frameChan) == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package dnstap
+
+import (
+	"accdns/common"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testField struct {
+	varint uint64
+	bytes  []byte
+}
+
+func decodeTestFields(t *testing.T, b []byte) map[int]testField {
+	fields := make(map[int]testField)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("truncated tag")
+		}
+		b = b[n:]
+		field := testField{}
+		switch tag & 7 {
+		case wireVarint:
+			field.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("truncated varint")
+			}
+			b = b[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatal("truncated bytes field")
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case wireFixed32:
+			field.varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields[int(tag>>3)] = field
+	}
+	return fields
+}
+
+func TestEncodeClientQuery(t *testing.T) {
+	queryTime := time.Unix(1700000000, 123456789)
+	msg := &message{
+		msgType:      MessageClientQuery,
+		protocol:     protocolUDP,
+		queryAddr:    net.ParseIP("192.0.2.1"),
+		queryPort:    53000,
+		responseAddr: net.ParseIP("192.0.2.53"),
+		responsePort: 53,
+		queryTime:    queryTime,
+		queryMessage: []byte{0x12, 0x34},
+	}
+	outer := decodeTestFields(t, msg.encode([]byte("host"), []byte("AccDNS")))
+	if string(outer[1].bytes) != "host" || string(outer[2].bytes) != "AccDNS" || outer[15].varint != dnstapTypeMessage {
+		t.Fatalf("got outer fields %v", outer)
+	}
+	inner := decodeTestFields(t, outer[14].bytes)
+	want := map[int]uint64{1: uint64(MessageClientQuery), 2: familyInet, 3: protocolUDP, 6: 53000, 7: 53, 8: 1700000000, 9: 123456789}
+	for field, value := range want {
+		if inner[field].varint != value {
+			t.Errorf("field %d = %d, want %d", field, inner[field].varint, value)
+		}
+	}
+	if !bytes.Equal(inner[4].bytes, []byte{192, 0, 2, 1}) || !bytes.Equal(inner[5].bytes, []byte{192, 0, 2, 53}) || !bytes.Equal(inner[10].bytes, []byte{0x12, 0x34}) {
+		t.Fatalf("got inner fields %v", inner)
+	}
+	for _, field := range []int{12, 13, 14} {
+		if _, ok := inner[field]; ok {
+			t.Errorf("query message has response field %d", field)
+		}
+	}
+}
+
+func TestEncodeForwarderResponse(t *testing.T) {
+	msg := &message{
+		msgType:         MessageForwarderResponse,
+		protocol:        protocolTCP,
+		responseAddr:    net.ParseIP("2001:db8::53"),
+		responsePort:    853,
+		queryTime:       time.Unix(1700000000, 0),
+		responseTime:    time.Unix(1700000001, 5),
+		responseMessage: make([]byte, 300),
+	}
+	outer := decodeTestFields(t, msg.encode(nil, nil))
+	if _, ok := outer[1]; ok {
+		t.Fatal("empty identity was encoded")
+	}
+	inner := decodeTestFields(t, outer[14].bytes)
+	if inner[2].varint != familyInet6 || inner[3].varint != protocolTCP || inner[7].varint != 853 || inner[12].varint != 1700000001 || inner[13].varint != 5 {
+		t.Fatalf("got inner fields %v", inner)
+	}
+	if !net.IP(inner[5].bytes).Equal(net.ParseIP("2001:db8::53")) || len(inner[14].bytes) != 300 {
+		t.Fatalf("got response address %v and %d message bytes", inner[5].bytes, len(inner[14].bytes))
+	}
+	if _, ok := inner[4]; ok {
+		t.Fatal("forwarder message has a query address")
+	}
+}
+
+func TestAppendVarint(t *testing.T) {
+	if b := appendVarint(nil, 300); !bytes.Equal(b, []byte{0xac, 0x02}) {
+		t.Fatalf("got %x", b)
+	}
+	if b := appendTag(nil, 14, wireBytes); !bytes.Equal(b, []byte{0x72}) {
+		t.Fatalf("got %x", b)
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	if err := writeControlFrame(buffer, controlStart, true); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 0, 0, 0, 0, 34, 0, 0, 0, controlStart, 0, 0, 0, controlFieldContentType, 0, 0, 0, 22}
+	want = append(want, contentType...)
+	if !bytes.Equal(buffer.Bytes(), want) {
+		t.Fatalf("got %x, want %x", buffer.Bytes(), want)
+	}
+	buffer.Reset()
+	if err := writeControlFrame(buffer, controlFinish, false); err != nil {
+		t.Fatal(err)
+	}
+	if controlType, err := readControlFrame(buffer); err != nil || controlType != controlFinish {
+		t.Fatalf("got control type %d (%v), want finish", controlType, err)
+	}
+	buffer.Reset()
+	if err := writeDataFrame(buffer, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), []byte{0, 0, 0, 4, 'd', 'a', 't', 'a'}) {
+		t.Fatalf("got data frame %x", buffer.Bytes())
+	}
+	if _, err := readControlFrame(buffer); err == nil {
+		t.Fatal("data frame was read as a control frame")
+	}
+}
+
+func readTestFrame(reader io.Reader) (uint32, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	if length := binary.BigEndian.Uint32(header); length > 0 {
+		payload := make([]byte, length)
+		_, err := io.ReadFull(reader, payload)
+		return 0, payload, err
+	}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(reader, frame); err != nil || len(frame) < 4 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return binary.BigEndian.Uint32(frame), nil, nil
+}
+
+func startTestOutput(t *testing.T, config *common.DnstapConfig) {
+	oldConfig := common.Config.Dnstap
+	common.Config.Dnstap = config
+	frameChan = nil
+	closed = false
+	t.Cleanup(func() {
+		Close()
+		common.Config.Dnstap = oldConfig
+		frameChan = nil
+	})
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileOutput(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	startTestOutput(t, &common.DnstapConfig{EnableDnstap: true, FilePath: filePath, Identity: "test", BufferSize: 16})
+	ClientQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, []byte{1, 2}, time.Now())
+	Close()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewReader(content)
+	if controlType, _, err := readTestFrame(reader); err != nil || controlType != controlStart {
+		t.Fatalf("first frame is control type %d (%v), want start", controlType, err)
+	}
+	_, payload, err := readTestFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outer := decodeTestFields(t, payload); string(outer[1].bytes) != "test" {
+		t.Fatalf("got identity %q", outer[1].bytes)
+	}
+	if controlType, _, err := readTestFrame(reader); err != nil || controlType != controlStop {
+		t.Fatalf("last frame is control type %d (%v), want stop", controlType, err)
+	}
+	if reader.Len() != 0 {
+		t.Fatalf("%d bytes after the stop frame", reader.Len())
+	}
+}
+
+func TestSocketOutput(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	resultChan := make(chan []uint32, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			resultChan <- nil
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		frames := make([]uint32, 0)
+		controlType, _, err := readTestFrame(conn)
+		frames = append(frames, controlType)
+		_ = writeControlFrame(conn, controlAccept, true)
+		for err == nil && controlType != controlStop {
+			controlType, _, err = readTestFrame(conn)
+			frames = append(frames, controlType)
+		}
+		_ = writeControlFrame(conn, controlFinish, false)
+		resultChan <- frames
+	}()
+	startTestOutput(t, &common.DnstapConfig{EnableDnstap: true, SocketPath: socketPath, BufferSize: 16})
+	ClientResponse(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::53"), Port: 53}, []byte{1, 2}, time.Now())
+	Close()
+	want := []uint32{controlReady, controlStart, 0, controlStop}
+	frames := <-resultChan
+	if len(frames) != len(want) {
+		t.Fatalf("collector got frames %v, want %v", frames, want)
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Fatalf("collector got frames %v, want %v", frames, want)
+		}
+	}
+}
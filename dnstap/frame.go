@@ -0,0 +1,64 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const contentType = "protobuf:dnstap.Dnstap"
+
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+	maxControlFrameSize     = 512
+)
+
+func writeDataFrame(writer io.Writer, payload []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(payload)
+	return err
+}
+
+func writeControlFrame(writer io.Writer, controlType uint32, withContentType bool) error {
+	frame := make([]byte, 12)
+	binary.BigEndian.PutUint32(frame[8:], controlType)
+	if withContentType {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field, controlFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(contentType)))
+		frame = append(frame, field...)
+		frame = append(frame, contentType...)
+	}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+	_, err := writer.Write(frame)
+	return err
+}
+
+func readControlFrame(reader io.Reader) (uint32, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header) != 0 {
+		return 0, errors.New("dnstap collector sent a data frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > maxControlFrameSize {
+		return 0, errors.New("dnstap control frame length is not correct")
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame), nil
+}
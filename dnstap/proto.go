@@ -0,0 +1,107 @@
+package dnstap
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+const (
+	dnstapTypeMessage = 1
+	familyInet        = 1
+	familyInet6       = 2
+)
+
+func (msg *message) encode(identity []byte, version []byte) []byte {
+	inner := make([]byte, 0, 64+len(msg.queryMessage)+len(msg.responseMessage))
+	inner = appendVarintField(inner, 1, uint64(msg.msgType))
+	family := familyInet6
+	if msg.queryAddr != nil && msg.queryAddr.To4() != nil || msg.queryAddr == nil && msg.responseAddr != nil && msg.responseAddr.To4() != nil {
+		family = familyInet
+	}
+	inner = appendVarintField(inner, 2, uint64(family))
+	inner = appendVarintField(inner, 3, uint64(msg.protocol))
+	if addr := addressBytes(msg.queryAddr, family); addr != nil {
+		inner = appendBytesField(inner, 4, addr)
+	}
+	if addr := addressBytes(msg.responseAddr, family); addr != nil {
+		inner = appendBytesField(inner, 5, addr)
+	}
+	if msg.queryAddr != nil {
+		inner = appendVarintField(inner, 6, uint64(msg.queryPort))
+	}
+	if msg.responseAddr != nil {
+		inner = appendVarintField(inner, 7, uint64(msg.responsePort))
+	}
+	if !msg.queryTime.IsZero() {
+		inner = appendTimeFields(inner, 8, 9, msg.queryTime)
+	}
+	if msg.queryMessage != nil {
+		inner = appendBytesField(inner, 10, msg.queryMessage)
+	}
+	if !msg.responseTime.IsZero() {
+		inner = appendTimeFields(inner, 12, 13, msg.responseTime)
+	}
+	if msg.responseMessage != nil {
+		inner = appendBytesField(inner, 14, msg.responseMessage)
+	}
+
+	outer := make([]byte, 0, len(inner)+len(identity)+len(version)+16)
+	if len(identity) > 0 {
+		outer = appendBytesField(outer, 1, identity)
+	}
+	if len(version) > 0 {
+		outer = appendBytesField(outer, 2, version)
+	}
+	outer = appendBytesField(outer, 14, inner)
+	outer = appendVarintField(outer, 15, dnstapTypeMessage)
+	return outer
+}
+
+func addressBytes(ip net.IP, family int) []byte {
+	if ip == nil {
+		return nil
+	}
+	if family == familyInet {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+func appendTimeFields(b []byte, secField int, nsecField int, t time.Time) []byte {
+	b = appendVarintField(b, secField, uint64(t.Unix()))
+	b = appendTag(b, nsecField, wireFixed32)
+	nsec := uint32(t.Nanosecond())
+	return append(b, byte(nsec), byte(nsec>>8), byte(nsec>>16), byte(nsec>>24))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
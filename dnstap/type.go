@@ -0,0 +1,21 @@
+package dnstap
+
+import (
+	"net"
+	"time"
+)
+
+type MessageType int
+
+type message struct {
+	msgType         MessageType
+	protocol        int
+	queryAddr       net.IP
+	queryPort       int
+	responseAddr    net.IP
+	responsePort    int
+	queryTime       time.Time
+	queryMessage    []byte
+	responseTime    time.Time
+	responseMessage []byte
+}
@@ -0,0 +1,303 @@
+package filter
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"bufio"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	BlockResponseNXDomain = "nxdomain"
+	BlockResponseRefused  = "refused"
+	BlockResponseZero     = "zero"
+	BlockResponseCustom   = "custom"
+)
+
+func Load(config *common.ConfigStruct) (*RuleSet, *BlockAction, error) {
+	if !config.Filter.EnableFilter {
+		return nil, nil, nil
+	}
+	action, err := parseBlockAction(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	ruleSet, err := LoadRuleSet(config.Filter.ListFilePaths)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Info("Load Filter Lists", ruleSet.NumOfRules, "rules from", len(config.Filter.ListFilePaths), "files")
+	return ruleSet, action, nil
+}
+
+func parseBlockAction(config *common.ConfigStruct) (*BlockAction, error) {
+	action := &BlockAction{
+		Response: strings.ToLower(config.Filter.BlockResponse),
+		IPv4:     net.IPv4zero.To4(),
+		IPv6:     net.IPv6zero,
+		TTL:      uint32(config.Filter.BlockTTL),
+	}
+	switch action.Response {
+	case BlockResponseNXDomain, BlockResponseRefused, BlockResponseZero:
+	case BlockResponseCustom:
+		action.IPv4 = nil
+		action.IPv6 = nil
+		if config.Filter.BlockIPv4 != "" {
+			action.IPv4 = net.ParseIP(config.Filter.BlockIPv4).To4()
+			if action.IPv4 == nil {
+				return nil, errors.New("block ipv4 address " + config.Filter.BlockIPv4 + " is not correct")
+			}
+		}
+		if config.Filter.BlockIPv6 != "" {
+			action.IPv6 = net.ParseIP(config.Filter.BlockIPv6)
+			if action.IPv6 == nil || action.IPv6.To4() != nil {
+				return nil, errors.New("block ipv6 address " + config.Filter.BlockIPv6 + " is not correct")
+			}
+		}
+	default:
+		return nil, errors.New("block response \"" + config.Filter.BlockResponse + "\" is not correct")
+	}
+	return action, nil
+}
+
+func LoadRuleSet(filePaths []string) (*RuleSet, error) {
+	ruleSet := &RuleSet{
+		blockedDomains:    make(map[string]bool),
+		blockedSuffixes:   make(map[string]bool),
+		exceptionDomains:  make(map[string]bool),
+		exceptionSuffixes: make(map[string]bool),
+		modTimes:          make(map[string]time.Time),
+	}
+	for _, filePath := range filePaths {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := ruleSet.loadFile(filePath); err != nil {
+			return nil, err
+		}
+		ruleSet.modTimes[filePath] = fileInfo.ModTime()
+	}
+	return ruleSet, nil
+}
+
+func (ruleSet *RuleSet) Changed() bool {
+	changed := false
+	for filePath, modTime := range ruleSet.modTimes {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			logger.Warning("Check Filter List", filePath, err)
+			continue
+		}
+		if !fileInfo.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (ruleSet *RuleSet) loadFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	skippedCount := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if isCommentLine(line) {
+			continue
+		}
+		if !ruleSet.AddRule(line) {
+			logger.Debug("Load Filter List", filePath, "line", lineNum, "is not supported:", line)
+			skippedCount++
+		}
+	}
+	if skippedCount > 0 {
+		logger.Warning("Load Filter List", filePath, "skipped", skippedCount, "unsupported lines")
+	}
+	return scanner.Err()
+}
+
+func isCommentLine(line string) bool {
+	return line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[")
+}
+
+func (ruleSet *RuleSet) AddRule(line string) bool {
+	line = strings.TrimSpace(line)
+	if isCommentLine(line) {
+		return false
+	}
+	if strings.HasPrefix(line, "|") || strings.HasPrefix(line, "@@") {
+		return ruleSet.addAdblockRule(line)
+	}
+	if index := strings.Index(line, "#"); index > 0 {
+		if line[index-1] != ' ' && line[index-1] != '\t' {
+			return false
+		}
+		line = strings.TrimSpace(line[:index])
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	if net.ParseIP(fields[0]) != nil {
+		added := false
+		for _, name := range fields[1:] {
+			name = normalizeDomain(name)
+			if isValidDomain(name) && !isLocalHostName(name) {
+				ruleSet.blockedDomains[name] = true
+				ruleSet.NumOfRules++
+				added = true
+			}
+		}
+		return added
+	}
+	if len(fields) != 1 {
+		return false
+	}
+	name := normalizeDomain(fields[0])
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+	}
+	if !isValidDomain(name) {
+		return false
+	}
+	ruleSet.blockedSuffixes[name] = true
+	ruleSet.NumOfRules++
+	return true
+}
+
+func (ruleSet *RuleSet) addAdblockRule(rule string) bool {
+	isException := false
+	if strings.HasPrefix(rule, "@@") {
+		isException = true
+		rule = rule[2:]
+	}
+	if index := strings.Index(rule, "$"); index >= 0 {
+		if rule[index+1:] != "important" {
+			return false
+		}
+		rule = rule[:index]
+	}
+	includeSubdomains := false
+	if strings.HasPrefix(rule, "||") {
+		includeSubdomains = true
+		rule = rule[2:]
+	} else if strings.HasPrefix(rule, "|") {
+		rule = rule[1:]
+	}
+	rule = strings.TrimSuffix(strings.TrimSuffix(rule, "|"), "^")
+	name := normalizeDomain(rule)
+	if !isValidDomain(name) {
+		return false
+	}
+	switch {
+	case isException && includeSubdomains:
+		ruleSet.exceptionSuffixes[name] = true
+	case isException:
+		ruleSet.exceptionDomains[name] = true
+	case includeSubdomains:
+		ruleSet.blockedSuffixes[name] = true
+	default:
+		ruleSet.blockedDomains[name] = true
+	}
+	ruleSet.NumOfRules++
+	return true
+}
+
+func (ruleSet *RuleSet) Match(name string) bool {
+	if ruleSet == nil {
+		return false
+	}
+	name = normalizeDomain(name)
+	if ruleSet.exceptionDomains[name] || matchSuffix(ruleSet.exceptionSuffixes, name) {
+		return false
+	}
+	return ruleSet.blockedDomains[name] || matchSuffix(ruleSet.blockedSuffixes, name)
+}
+
+func matchSuffix(suffixes map[string]bool, name string) bool {
+	if len(suffixes) == 0 {
+		return false
+	}
+	for {
+		if suffixes[name] {
+			return true
+		}
+		index := strings.Index(name, ".")
+		if index < 0 {
+			return false
+		}
+		name = name[index+1:]
+	}
+}
+
+func (action *BlockAction) NewResponse(question *dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:           true,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeSuccess,
+		},
+		Questions: []dnsmessage.Question{*question},
+		Answers:   make([]dnsmessage.Resource, 0),
+	}
+	switch action.Response {
+	case BlockResponseNXDomain:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	case BlockResponseRefused:
+		msg.Header.RCode = dnsmessage.RCodeRefused
+	default:
+		header := dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: question.Class,
+			TTL:   action.TTL,
+		}
+		if question.Type == dnsmessage.TypeA && action.IPv4 != nil {
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], action.IPv4)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: body})
+		} else if question.Type == dnsmessage.TypeAAAA && action.IPv6 != nil {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], action.IPv6)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: body})
+		}
+	}
+	return msg
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func isValidDomain(name string) bool {
+	if name == "" || len(name) > 253 || strings.HasPrefix(name, ".") || strings.Contains(name, "..") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func isLocalHostName(name string) bool {
+	switch name {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+	return false
+}
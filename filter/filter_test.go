@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRuleSet(t *testing.T, lines ...string) *RuleSet {
+	ruleSet, err := LoadRuleSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		ruleSet.AddRule(line)
+	}
+	return ruleSet
+}
+
+func TestAddRule(t *testing.T) {
+	testCases := []struct {
+		line  string
+		added bool
+	}{
+		{"0.0.0.0 ads.example.com tracker.example.com", true},
+		{"127.0.0.1 localhost", false},
+		{"ads.example.net", true},
+		{"*.wild.example.net", true},
+		{"plain.example.org # trailing comment", true},
+		{"||ads.example.org^", true},
+		{"|exact.example.org^", true},
+		{"|exact.example.org|", true},
+		{"@@||cdn.example.org^", true},
+		{"@@|api.example.org^", true},
+		{"||important.example.org^$important", true},
+		{"||thirdparty.example.org^$third-party", false},
+		{"example.com##.banner", false},
+		{"example.com#@#.banner", false},
+		{"! adblock comment", false},
+		{"# hosts comment", false},
+		{"[Adblock Plus 2.0]", false},
+		{"two words", false},
+		{"", false},
+	}
+	for _, testCase := range testCases {
+		ruleSet := newTestRuleSet(t)
+		if added := ruleSet.AddRule(testCase.line); added != testCase.added {
+			t.Errorf("AddRule(%q) = %v, want %v", testCase.line, added, testCase.added)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	ruleSet := newTestRuleSet(t,
+		"0.0.0.0 hosts.example.com",
+		"plain.example.com",
+		"*.wild.example.com",
+		"||suffix.example.com^",
+		"|exact.example.com^",
+		"@@||allowed.suffix.example.com^",
+		"@@|only.plain.example.com^",
+		"example.com##.banner",
+	)
+	testCases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"hosts.example.com.", true},
+		{"sub.hosts.example.com.", false},
+		{"plain.example.com.", true},
+		{"sub.plain.example.com.", true},
+		{"only.plain.example.com.", false},
+		{"sub.only.plain.example.com.", true},
+		{"wild.example.com.", true},
+		{"a.wild.example.com.", true},
+		{"SUFFIX.Example.COM.", true},
+		{"a.b.suffix.example.com.", true},
+		{"allowed.suffix.example.com.", false},
+		{"x.allowed.suffix.example.com.", false},
+		{"exact.example.com.", true},
+		{"sub.exact.example.com.", false},
+		{"example.com.", false},
+		{"other.example.net.", false},
+	}
+	for _, testCase := range testCases {
+		if blocked := ruleSet.Match(testCase.name); blocked != testCase.blocked {
+			t.Errorf("Match(%q) = %v, want %v", testCase.name, blocked, testCase.blocked)
+		}
+	}
+}
+
+func TestLoadRuleSetCountsRules(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "list.txt")
+	content := "! title\n0.0.0.0 a.example.com b.example.com\n||c.example.com^\n|d.example.com^\n@@||e.example.com^\nexample.com##.banner\n"
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ruleSet, err := LoadRuleSet([]string{filePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ruleSet.NumOfRules != 5 {
+		t.Fatalf("got %d rules, want 5", ruleSet.NumOfRules)
+	}
+	if ruleSet.Changed() {
+		t.Fatal("unchanged list reported as changed")
+	}
+}
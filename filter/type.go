@@ -0,0 +1,22 @@
+package filter
+
+import (
+	"net"
+	"time"
+)
+
+type RuleSet struct {
+	blockedDomains    map[string]bool
+	blockedSuffixes   map[string]bool
+	exceptionDomains  map[string]bool
+	exceptionSuffixes map[string]bool
+	modTimes          map[string]time.Time
+	NumOfRules        int
+}
+
+type BlockAction struct {
+	Response string
+	IPv4     net.IP
+	IPv6     net.IP
+	TTL      uint32
+}
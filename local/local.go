@@ -0,0 +1,316 @@
+package local
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"bufio"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const maxCNAMEChainLength = 8
+
+func Load(config *common.ConfigStruct) (*RecordStore, error) {
+	store := &RecordStore{
+		records: make(map[string]map[dnsmessage.Type][]dnsmessage.Resource),
+	}
+	ttl := uint32(config.Local.TTL)
+	if config.Local.HostsFilePath != "" {
+		if err := store.LoadHostsFile(config.Local.HostsFilePath, ttl); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range config.Local.Records {
+		if err := store.AddRecord(record, ttl); err != nil {
+			return nil, err
+		}
+	}
+	if store.NumOfNames > 0 {
+		logger.Info("Load Local Records", store.NumOfNames, "names")
+	}
+	for _, zoneFilePath := range config.Local.ZoneFilePaths {
+		zone, err := LoadZoneFile(zoneFilePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, loadedZone := range store.zones {
+			if loadedZone.Origin == zone.Origin {
+				return nil, errors.New("zone " + zone.Origin + " is loaded more than once")
+			}
+		}
+		store.zones = append(store.zones, zone)
+		logger.Info("Load Zone", zone.Origin, "from", zoneFilePath)
+	}
+	return store, nil
+}
+
+func (store *RecordStore) LoadHostsFile(filePath string, ttl uint32) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			logger.Warning("Load Hosts File", filePath, "line", lineNum, "is not correct")
+			continue
+		}
+		for _, name := range fields[1:] {
+			if err := store.addAddress(name, ip, ttl); err != nil {
+				logger.Warning("Load Hosts File", filePath, "line", lineNum, err)
+			}
+		}
+		ptrName, err := dnsmessage.NewName(ReverseName(ip))
+		if err != nil {
+			continue
+		}
+		target, err := newFQDN(fields[1])
+		if err != nil {
+			continue
+		}
+		if len(store.lookup(ptrName.String(), dnsmessage.TypePTR)) == 0 {
+			store.add(dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: ptrName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: target},
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+func (store *RecordStore) addAddress(name string, ip net.IP, ttl uint32) error {
+	owner, err := newFQDN(name)
+	if err != nil {
+		return err
+	}
+	header := dnsmessage.ResourceHeader{Name: owner, Class: dnsmessage.ClassINET, TTL: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		header.Type = dnsmessage.TypeA
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip4)
+		store.add(dnsmessage.Resource{Header: header, Body: body})
+	} else {
+		header.Type = dnsmessage.TypeAAAA
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip.To16())
+		store.add(dnsmessage.Resource{Header: header, Body: body})
+	}
+	return nil
+}
+
+func (store *RecordStore) AddRecord(record string, ttl uint32) error {
+	fields := strings.Fields(record)
+	if len(fields) < 3 {
+		return errors.New("local record \"" + record + "\" is not correct")
+	}
+	owner, err := newFQDN(fields[0])
+	if err != nil {
+		return err
+	}
+	rType, err := common.ParseRecordType(fields[1])
+	if err != nil {
+		return err
+	}
+	body, err := parseRecordBody(rType, fields[2:])
+	if err != nil {
+		return errors.New("local record \"" + record + "\" is not correct: " + err.Error())
+	}
+	store.add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: owner, Type: rType, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	})
+	return nil
+}
+
+func parseRecordBody(rType dnsmessage.Type, fields []string) (dnsmessage.ResourceBody, error) {
+	switch rType {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil || len(fields) != 1 {
+			return nil, errors.New("wrong ipv4 address")
+		}
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip)
+		return body, nil
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil || len(fields) != 1 {
+			return nil, errors.New("wrong ipv6 address")
+		}
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip)
+		return body, nil
+	case dnsmessage.TypeCNAME, dnsmessage.TypePTR, dnsmessage.TypeNS:
+		if len(fields) != 1 {
+			return nil, errors.New("wrong target")
+		}
+		target, err := newFQDN(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		switch rType {
+		case dnsmessage.TypeCNAME:
+			return &dnsmessage.CNAMEResource{CNAME: target}, nil
+		case dnsmessage.TypePTR:
+			return &dnsmessage.PTRResource{PTR: target}, nil
+		default:
+			return &dnsmessage.NSResource{NS: target}, nil
+		}
+	case dnsmessage.TypeTXT:
+		return &dnsmessage.TXTResource{TXT: splitTXT(fields)}, nil
+	case dnsmessage.TypeMX:
+		if len(fields) != 2 {
+			return nil, errors.New("wrong mx record")
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		exchange, err := newFQDN(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.MXResource{Pref: uint16(pref), MX: exchange}, nil
+	case dnsmessage.TypeSRV:
+		if len(fields) != 4 {
+			return nil, errors.New("wrong srv record")
+		}
+		values := make([]uint16, 3)
+		for i := range values {
+			value, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = uint16(value)
+		}
+		target, err := newFQDN(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.SRVResource{Priority: values[0], Weight: values[1], Port: values[2], Target: target}, nil
+	}
+	return nil, errors.New("record type " + rType.String() + " is not supported")
+}
+
+func splitTXT(fields []string) []string {
+	text := strings.Join(fields, " ")
+	if len(text) >= 2 && strings.HasPrefix(text, "\"") && strings.HasSuffix(text, "\"") {
+		text = text[1 : len(text)-1]
+	}
+	txt := make([]string, 0)
+	for len(text) > 255 {
+		txt = append(txt, text[:255])
+		text = text[255:]
+	}
+	return append(txt, text)
+}
+
+func (store *RecordStore) add(res dnsmessage.Resource) {
+	name := strings.ToLower(res.Header.Name.String())
+	types, ok := store.records[name]
+	if !ok {
+		types = make(map[dnsmessage.Type][]dnsmessage.Resource)
+		store.records[name] = types
+		store.NumOfNames++
+	}
+	types[res.Header.Type] = append(types[res.Header.Type], res)
+}
+
+func (store *RecordStore) lookup(name string, rType dnsmessage.Type) []dnsmessage.Resource {
+	return store.records[strings.ToLower(name)][rType]
+}
+
+func (store *RecordStore) resolve(name string, qType dnsmessage.Type, depth int) []dnsmessage.Resource {
+	types, ok := store.records[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	if qType == dnsmessage.TypeALL {
+		answers := make([]dnsmessage.Resource, 0)
+		for _, resources := range types {
+			answers = append(answers, resources...)
+		}
+		return answers
+	}
+	if resources := types[qType]; len(resources) > 0 {
+		return append([]dnsmessage.Resource{}, resources...)
+	}
+	cnames := types[dnsmessage.TypeCNAME]
+	if len(cnames) == 0 || depth >= maxCNAMEChainLength {
+		return nil
+	}
+	answers := append([]dnsmessage.Resource{}, cnames[0])
+	target := cnames[0].Body.(*dnsmessage.CNAMEResource).CNAME
+	return append(answers, store.resolve(target.String(), qType, depth+1)...)
+}
+
+func (store *RecordStore) Lookup(question *dnsmessage.Question) *dnsmessage.Message {
+	if question.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	if _, ok := store.records[strings.ToLower(question.Name.String())]; !ok {
+		if zone := store.findZone(question.Name.String()); zone != nil {
+			return zone.Lookup(question)
+		}
+		return nil
+	}
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:           true,
+			Authoritative:      true,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeSuccess,
+		},
+		Questions: []dnsmessage.Question{*question},
+		Answers:   store.resolve(question.Name.String(), question.Type, 0),
+	}
+}
+
+func (store *RecordStore) findZone(name string) *Zone {
+	name = strings.ToLower(name)
+	var matchedZone *Zone
+	for _, zone := range store.zones {
+		if isSubdomain(name, zone.Origin) && (matchedZone == nil || len(zone.Origin) > len(matchedZone.Origin)) {
+			matchedZone = zone
+		}
+	}
+	return matchedZone
+}
+
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." + strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0])) + ".in-addr.arpa."
+	}
+	const hexDigits = "0123456789abcdef"
+	ip16 := ip.To16()
+	name := make([]byte, 0, 73)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		name = append(name, hexDigits[ip16[i]&0x0f], '.', hexDigits[ip16[i]>>4], '.')
+	}
+	return string(name) + "ip6.arpa."
+}
+
+func newFQDN(name string) (dnsmessage.Name, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return dnsmessage.NewName(name)
+}
@@ -0,0 +1,105 @@
+package local
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore() *RecordStore {
+	return &RecordStore{records: make(map[string]map[dnsmessage.Type][]dnsmessage.Resource)}
+}
+
+func testQuestion(name string, qType dnsmessage.Type) *dnsmessage.Question {
+	return &dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qType, Class: dnsmessage.ClassINET}
+}
+
+func TestLoadHostsFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "hosts")
+	content := "# comment\n192.168.1.10 nas.lan NAS-Alias.lan # trailing\n2001:db8::1 v6.lan\nnot-an-ip broken.lan\n192.168.1.10\n192.168.1.10 other.lan\n"
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore()
+	if err := store.LoadHostsFile(filePath, 600); err != nil {
+		t.Fatal(err)
+	}
+	msg := store.Lookup(testQuestion("nas-alias.LAN.", dnsmessage.TypeA))
+	if msg == nil || len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 168, 1, 10} || msg.Answers[0].Header.TTL != 600 {
+		t.Fatalf("got %v, want the hosts address", msg)
+	}
+	msg = store.Lookup(testQuestion("v6.lan.", dnsmessage.TypeAAAA))
+	if msg == nil || len(msg.Answers) != 1 || net.IP(msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]).String() != "2001:db8::1" {
+		t.Fatalf("got %v, want the ipv6 hosts address", msg)
+	}
+	if msg := store.Lookup(testQuestion("v6.lan.", dnsmessage.TypeA)); msg == nil || len(msg.Answers) != 0 {
+		t.Fatalf("got %v, want an empty answer", msg)
+	}
+	if msg := store.Lookup(testQuestion("broken.lan.", dnsmessage.TypeA)); msg != nil {
+		t.Fatalf("got %v for a malformed line", msg)
+	}
+	msg = store.Lookup(testQuestion("10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR))
+	if msg == nil || len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != "nas.lan." {
+		t.Fatalf("got %v, want a ptr to the first name", msg)
+	}
+}
+
+func TestAddRecord(t *testing.T) {
+	testCases := []struct {
+		record string
+		ok     bool
+	}{
+		{"www.lan A 192.168.1.20", true},
+		{"www.lan AAAA 2001:db8::20", true},
+		{"lan MX 10 mail.lan", true},
+		{"_http._tcp.lan SRV 0 5 80 www.lan", true},
+		{"txt.lan TXT \"hello world\"", true},
+		{"alias.lan CNAME www.lan", true},
+		{"www.lan A 2001:db8::20", false},
+		{"www.lan AAAA 192.168.1.20", false},
+		{"lan MX mail.lan", false},
+		{"_http._tcp.lan SRV 0 5 mail.lan", false},
+		{"www.lan NOPE 1", false},
+		{"www.lan A", false},
+	}
+	for _, testCase := range testCases {
+		err := newTestStore().AddRecord(testCase.record, 60)
+		if (err == nil) != testCase.ok {
+			t.Errorf("AddRecord(%q) returned %v", testCase.record, err)
+		}
+	}
+}
+
+func TestLookupFollowsCNAME(t *testing.T) {
+	store := newTestStore()
+	for _, record := range []string{"www.lan A 192.168.1.20", "alias.lan CNAME www.lan", "loop1.lan CNAME loop2.lan", "loop2.lan CNAME loop1.lan", "txt.lan TXT \"hello world\""} {
+		if err := store.AddRecord(record, 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := store.Lookup(testQuestion("alias.lan.", dnsmessage.TypeA))
+	if msg == nil || len(msg.Answers) != 2 || msg.Answers[0].Header.Type != dnsmessage.TypeCNAME || msg.Answers[1].Header.Type != dnsmessage.TypeA {
+		t.Fatalf("got %v, want cname then address", msg)
+	}
+	if msg := store.Lookup(testQuestion("loop1.lan.", dnsmessage.TypeA)); len(msg.Answers) != maxCNAMEChainLength {
+		t.Fatalf("got %d answers for a cname loop, want %d", len(msg.Answers), maxCNAMEChainLength)
+	}
+	msg = store.Lookup(testQuestion("txt.lan.", dnsmessage.TypeTXT))
+	if txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT; len(txt) != 1 || txt[0] != "hello world" {
+		t.Fatalf("got txt %q, want unquoted text", txt)
+	}
+	if msg := store.Lookup(&dnsmessage.Question{Name: dnsmessage.MustNewName("www.lan."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassCHAOS}); msg != nil {
+		t.Fatalf("got %v for a chaos query", msg)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if name := ReverseName(net.ParseIP("192.0.2.1")); name != "1.2.0.192.in-addr.arpa." {
+		t.Fatalf("got %s", name)
+	}
+	if name := ReverseName(net.ParseIP("2001:db8::1")); name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Fatalf("got %s", name)
+	}
+}
@@ -0,0 +1,32 @@
+package local
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type RecordStore struct {
+	zones      []*Zone
+	records    map[string]map[dnsmessage.Type][]dnsmessage.Resource
+	NumOfNames int
+}
+
+type Zone struct {
+	Origin  string
+	records map[string]map[dnsmessage.Type][]dnsmessage.Resource
+	names   map[string]bool
+	cuts    map[string]bool
+	soa     dnsmessage.Resource
+}
+
+type zoneParser struct {
+	zone      *Zone
+	origin    string
+	ttl       uint32
+	lastOwner string
+}
+
+type zoneLine struct {
+	tokens    []string
+	continued bool
+	lineNum   int
+}
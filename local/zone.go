@@ -0,0 +1,493 @@
+package local
+
+import (
+	"accdns/common"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultZoneTTL = 3600
+
+func LoadZoneFile(filePath string) (*Zone, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := tokenizeZone(string(content))
+	if err != nil {
+		return nil, errors.New(filePath + ": " + err.Error())
+	}
+	parser := &zoneParser{
+		ttl: defaultZoneTTL,
+		zone: &Zone{
+			records: make(map[string]map[dnsmessage.Type][]dnsmessage.Resource),
+			names:   make(map[string]bool),
+			cuts:    make(map[string]bool),
+		},
+	}
+	for _, line := range lines {
+		if err := parser.parseLine(line); err != nil {
+			return nil, errors.New(filePath + " line " + strconv.Itoa(line.lineNum) + ": " + err.Error())
+		}
+	}
+	zone := parser.zone
+	if zone.Origin == "" {
+		return nil, errors.New(filePath + ": zone has no SOA record")
+	}
+	soas := zone.records[zone.Origin][dnsmessage.TypeSOA]
+	if len(soas) != 1 {
+		return nil, errors.New(filePath + ": zone must have exactly one SOA record at its origin")
+	}
+	zone.soa = soas[0]
+	for name := range zone.records {
+		if !isSubdomain(name, zone.Origin) {
+			return nil, errors.New(filePath + ": record " + name + " is out of zone " + zone.Origin)
+		}
+		if name != zone.Origin && len(zone.records[name][dnsmessage.TypeNS]) > 0 {
+			zone.cuts[name] = true
+		}
+		for parent := name; parent != zone.Origin; parent = parentName(parent) {
+			zone.names[parent] = true
+		}
+	}
+	zone.names[zone.Origin] = true
+	return zone, nil
+}
+
+func tokenizeZone(content string) ([]zoneLine, error) {
+	lines := make([]zoneLine, 0)
+	current := zoneLine{lineNum: 1, continued: len(content) > 0 && (content[0] == ' ' || content[0] == '\t')}
+	depth := 0
+	lineNum := 1
+	token := strings.Builder{}
+	inToken := false
+	inQuote := false
+	flushToken := func() {
+		if inToken {
+			current.tokens = append(current.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if inQuote {
+			switch c {
+			case '\\':
+				if i+1 < len(content) {
+					i++
+					token.WriteByte(content[i])
+				}
+			case '"':
+				inQuote = false
+				flushToken()
+			case '\n':
+				return nil, errors.New("line " + strconv.Itoa(lineNum) + ": unterminated quoted string")
+			default:
+				token.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case ';':
+			for i+1 < len(content) && content[i+1] != '\n' {
+				i++
+			}
+		case '"':
+			flushToken()
+			inQuote = true
+			inToken = true
+		case '(':
+			flushToken()
+			depth++
+		case ')':
+			flushToken()
+			if depth == 0 {
+				return nil, errors.New("line " + strconv.Itoa(lineNum) + ": unbalanced parentheses")
+			}
+			depth--
+		case ' ', '\t', '\r':
+			flushToken()
+		case '\n':
+			flushToken()
+			lineNum++
+			if depth == 0 {
+				if len(current.tokens) > 0 {
+					lines = append(lines, current)
+				}
+				current = zoneLine{lineNum: lineNum}
+				if i+1 < len(content) && (content[i+1] == ' ' || content[i+1] == '\t') {
+					current.continued = true
+				}
+			}
+		case '\\':
+			token.WriteByte(c)
+			if i+1 < len(content) {
+				i++
+				token.WriteByte(content[i])
+			}
+			inToken = true
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("line " + strconv.Itoa(lineNum) + ": unterminated quoted string")
+	}
+	if depth != 0 {
+		return nil, errors.New("line " + strconv.Itoa(lineNum) + ": unbalanced parentheses")
+	}
+	flushToken()
+	if len(current.tokens) > 0 {
+		lines = append(lines, current)
+	}
+	return lines, nil
+}
+
+func (parser *zoneParser) parseLine(line zoneLine) error {
+	tokens := line.tokens
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) != 2 || !strings.HasSuffix(tokens[1], ".") {
+			return errors.New("$ORIGIN needs an absolute domain name")
+		}
+		parser.origin = strings.ToLower(tokens[1])
+		return nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return errors.New("$TTL needs a value")
+		}
+		ttl, err := parseZoneTTL(tokens[1])
+		if err != nil {
+			return err
+		}
+		parser.ttl = ttl
+		return nil
+	case "$INCLUDE", "$GENERATE":
+		return errors.New(tokens[0] + " is not supported")
+	}
+	if !line.continued {
+		owner, err := parser.absoluteName(tokens[0])
+		if err != nil {
+			return err
+		}
+		parser.lastOwner = owner
+		tokens = tokens[1:]
+	} else if parser.lastOwner == "" {
+		return errors.New("record has no owner name")
+	}
+	ttl := parser.ttl
+	rType := dnsmessage.Type(0)
+	for len(tokens) > 0 && rType == 0 {
+		text := strings.ToUpper(tokens[0])
+		tokens = tokens[1:]
+		switch {
+		case text == "IN":
+		case text == "CH" || text == "HS" || text == "CS":
+			return errors.New("class " + text + " is not supported")
+		case text[0] >= '0' && text[0] <= '9':
+			parsedTTL, err := parseZoneTTL(text)
+			if err != nil {
+				return err
+			}
+			ttl = parsedTTL
+		default:
+			parsedType, err := common.ParseRecordType(text)
+			if err != nil {
+				return err
+			}
+			rType = parsedType
+		}
+	}
+	if rType == 0 {
+		return errors.New("record has no type")
+	}
+	if len(tokens) == 0 {
+		return errors.New("record has no data")
+	}
+	body, err := parser.parseBody(rType, tokens)
+	if err != nil {
+		return err
+	}
+	owner, err := dnsmessage.NewName(parser.lastOwner)
+	if err != nil {
+		return err
+	}
+	res := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: owner, Type: rType, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+	if rType == dnsmessage.TypeSOA {
+		if parser.zone.Origin != "" {
+			return errors.New("zone has more than one SOA record")
+		}
+		parser.zone.Origin = parser.lastOwner
+		if parser.origin == "" {
+			parser.origin = parser.lastOwner
+		}
+	}
+	name := strings.ToLower(parser.lastOwner)
+	types, ok := parser.zone.records[name]
+	if !ok {
+		types = make(map[dnsmessage.Type][]dnsmessage.Resource)
+		parser.zone.records[name] = types
+	}
+	types[rType] = append(types[rType], res)
+	return nil
+}
+
+func (parser *zoneParser) parseBody(rType dnsmessage.Type, tokens []string) (dnsmessage.ResourceBody, error) {
+	fields := append([]string{}, tokens...)
+	switch rType {
+	case dnsmessage.TypeSOA:
+		if len(fields) != 7 {
+			return nil, errors.New("wrong soa record")
+		}
+		ns, err := parser.absoluteDNSName(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		mbox, err := parser.absoluteDNSName(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		serial, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]uint32, 4)
+		for i := range values {
+			if values[i], err = parseZoneTTL(fields[3+i]); err != nil {
+				return nil, err
+			}
+		}
+		return &dnsmessage.SOAResource{NS: ns, MBox: mbox, Serial: uint32(serial), Refresh: values[0], Retry: values[1], Expire: values[2], MinTTL: values[3]}, nil
+	case dnsmessage.TypeTXT:
+		return &dnsmessage.TXTResource{TXT: fields}, nil
+	case dnsmessage.TypeCNAME, dnsmessage.TypePTR, dnsmessage.TypeNS:
+		if len(fields) != 1 {
+			return nil, errors.New("wrong target")
+		}
+		fields[0] = parser.absoluteNameOrRaw(fields[0])
+	case dnsmessage.TypeMX:
+		if len(fields) != 2 {
+			return nil, errors.New("wrong mx record")
+		}
+		fields[1] = parser.absoluteNameOrRaw(fields[1])
+	case dnsmessage.TypeSRV:
+		if len(fields) != 4 {
+			return nil, errors.New("wrong srv record")
+		}
+		fields[3] = parser.absoluteNameOrRaw(fields[3])
+	}
+	return parseRecordBody(rType, fields)
+}
+
+func (parser *zoneParser) absoluteName(name string) (string, error) {
+	if name == "@" {
+		if parser.origin == "" {
+			return "", errors.New("@ is used before $ORIGIN")
+		}
+		return parser.origin, nil
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.ToLower(name), nil
+	}
+	if parser.origin == "" {
+		return "", errors.New("relative name " + name + " is used before $ORIGIN")
+	}
+	if parser.origin == "." {
+		return strings.ToLower(name) + ".", nil
+	}
+	return strings.ToLower(name) + "." + parser.origin, nil
+}
+
+func (parser *zoneParser) absoluteNameOrRaw(name string) string {
+	absName, err := parser.absoluteName(name)
+	if err != nil {
+		return name
+	}
+	return absName
+}
+
+func (parser *zoneParser) absoluteDNSName(name string) (dnsmessage.Name, error) {
+	absName, err := parser.absoluteName(name)
+	if err != nil {
+		return dnsmessage.Name{}, err
+	}
+	return dnsmessage.NewName(absName)
+}
+
+func parseZoneTTL(text string) (uint32, error) {
+	total := uint64(0)
+	value := uint64(0)
+	hasDigit := false
+	for _, c := range strings.ToLower(text) {
+		if c >= '0' && c <= '9' {
+			value = value*10 + uint64(c-'0')
+			hasDigit = true
+			if value > 0xffffffff {
+				return 0, errors.New("ttl " + text + " is too large")
+			}
+			continue
+		}
+		if !hasDigit {
+			return 0, errors.New("ttl " + text + " is not correct")
+		}
+		switch c {
+		case 's':
+		case 'm':
+			value *= 60
+		case 'h':
+			value *= 3600
+		case 'd':
+			value *= 86400
+		case 'w':
+			value *= 604800
+		default:
+			return 0, errors.New("ttl " + text + " is not correct")
+		}
+		total += value
+		value = 0
+		hasDigit = false
+	}
+	total += value
+	if total > 0xffffffff {
+		return 0, errors.New("ttl " + text + " is too large")
+	}
+	return uint32(total), nil
+}
+
+func (zone *Zone) Lookup(question *dnsmessage.Question) *dnsmessage.Message {
+	qName := strings.ToLower(question.Name.String())
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:           true,
+			Authoritative:      true,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeSuccess,
+		},
+		Questions:   []dnsmessage.Question{*question},
+		Answers:     make([]dnsmessage.Resource, 0),
+		Authorities: make([]dnsmessage.Resource, 0),
+		Additionals: make([]dnsmessage.Resource, 0),
+	}
+	if cut := zone.findCut(qName); cut != "" && !(cut == qName && question.Type == dnsmessage.Type(43)) {
+		msg.Header.Authoritative = false
+		nsRecords := zone.records[cut][dnsmessage.TypeNS]
+		msg.Authorities = append(msg.Authorities, nsRecords...)
+		msg.Additionals = append(msg.Additionals, zone.glue(nsRecords)...)
+		return msg
+	}
+	zone.answer(msg, qName, question.Name, question.Type, 0)
+	return msg
+}
+
+func (zone *Zone) answer(msg *dnsmessage.Message, qName string, owner dnsmessage.Name, qType dnsmessage.Type, depth int) {
+	types, exists := zone.records[qName]
+	if !exists && !zone.names[qName] {
+		wildcard := "*." + zone.closestEncloser(qName)
+		wildcardTypes, ok := zone.records[wildcard]
+		if !ok {
+			if depth == 0 {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			}
+			msg.Authorities = append(msg.Authorities, zone.negativeSOA())
+			return
+		}
+		types = make(map[dnsmessage.Type][]dnsmessage.Resource)
+		for rType, resources := range wildcardTypes {
+			for _, res := range resources {
+				res.Header.Name = owner
+				types[rType] = append(types[rType], res)
+			}
+		}
+	}
+	if qType == dnsmessage.TypeALL && len(types) > 0 {
+		for _, resources := range types {
+			msg.Answers = append(msg.Answers, resources...)
+		}
+		return
+	}
+	if resources := types[qType]; len(resources) > 0 {
+		msg.Answers = append(msg.Answers, resources...)
+		if qType == dnsmessage.TypeNS || qType == dnsmessage.TypeMX || qType == dnsmessage.TypeSRV {
+			msg.Additionals = append(msg.Additionals, zone.glue(resources)...)
+		}
+		return
+	}
+	if cnames := types[dnsmessage.TypeCNAME]; len(cnames) > 0 && depth < maxCNAMEChainLength {
+		msg.Answers = append(msg.Answers, cnames[0])
+		target := cnames[0].Body.(*dnsmessage.CNAMEResource).CNAME
+		targetName := strings.ToLower(target.String())
+		if isSubdomain(targetName, zone.Origin) && zone.findCut(targetName) == "" {
+			zone.answer(msg, targetName, target, qType, depth+1)
+		}
+		return
+	}
+	msg.Authorities = append(msg.Authorities, zone.negativeSOA())
+}
+
+func (zone *Zone) findCut(qName string) string {
+	cut := ""
+	for name := qName; name != zone.Origin && isSubdomain(name, zone.Origin); name = parentName(name) {
+		if zone.cuts[name] {
+			cut = name
+		}
+	}
+	return cut
+}
+
+func (zone *Zone) closestEncloser(qName string) string {
+	for name := parentName(qName); name != zone.Origin; name = parentName(name) {
+		if zone.names[name] {
+			return name
+		}
+	}
+	return zone.Origin
+}
+
+func (zone *Zone) glue(resources []dnsmessage.Resource) []dnsmessage.Resource {
+	glue := make([]dnsmessage.Resource, 0)
+	for _, res := range resources {
+		var target dnsmessage.Name
+		switch body := res.Body.(type) {
+		case *dnsmessage.NSResource:
+			target = body.NS
+		case *dnsmessage.MXResource:
+			target = body.MX
+		case *dnsmessage.SRVResource:
+			target = body.Target
+		default:
+			continue
+		}
+		targetName := strings.ToLower(target.String())
+		glue = append(glue, zone.records[targetName][dnsmessage.TypeA]...)
+		glue = append(glue, zone.records[targetName][dnsmessage.TypeAAAA]...)
+	}
+	return glue
+}
+
+func (zone *Zone) negativeSOA() dnsmessage.Resource {
+	soa := zone.soa
+	if minTTL := soa.Body.(*dnsmessage.SOAResource).MinTTL; minTTL < soa.Header.TTL {
+		soa.Header.TTL = minTTL
+	}
+	return soa
+}
+
+func isSubdomain(name string, zoneName string) bool {
+	return zoneName == "." || name == zoneName || strings.HasSuffix(name, "."+zoneName)
+}
+
+func parentName(name string) string {
+	index := strings.Index(name, ".")
+	if index < 0 || index == len(name)-1 {
+		return "."
+	}
+	return name[index+1:]
+}
@@ -0,0 +1,137 @@
+package local
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN lab.internal.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h 30m 1w 300 )
+	IN	NS	ns1
+ns1	IN	A	10.0.0.1
+www	300	IN	A	10.0.0.10
+	IN	AAAA	2001:db8::10
+alias	CNAME	www
+mail	MX	10 mail.lab.internal.
+txt	TXT	"hello \"zone\"" second
+*.wild	A	10.0.0.20
+a.b.deep	A	10.0.0.30
+sub	NS	ns.sub
+ns.sub	A	10.0.1.1
+`
+
+func loadTestZone(t *testing.T, content string) (*Zone, error) {
+	filePath := filepath.Join(t.TempDir(), "test.zone")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadZoneFile(filePath)
+}
+
+func TestLoadZoneFile(t *testing.T) {
+	zone, err := loadTestZone(t, testZoneFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Origin != "lab.internal." {
+		t.Fatalf("got origin %s", zone.Origin)
+	}
+	soa := zone.soa.Body.(*dnsmessage.SOAResource)
+	if soa.NS.String() != "ns1.lab.internal." || soa.Serial != 2024010101 || soa.Refresh != 7200 || soa.Retry != 1800 || soa.Expire != 604800 || soa.MinTTL != 300 {
+		t.Fatalf("got soa %+v", soa)
+	}
+	www := zone.records["www.lab.internal."]
+	if len(www[dnsmessage.TypeA]) != 1 || www[dnsmessage.TypeA][0].Header.TTL != 300 {
+		t.Fatalf("got www records %v, want one A record with ttl 300", www)
+	}
+	if len(www[dnsmessage.TypeAAAA]) != 1 || www[dnsmessage.TypeAAAA][0].Header.TTL != 3600 {
+		t.Fatalf("continuation line did not inherit the owner and $TTL: %v", www)
+	}
+	txt := zone.records["txt.lab.internal."][dnsmessage.TypeTXT][0].Body.(*dnsmessage.TXTResource).TXT
+	if len(txt) != 2 || txt[0] != `hello "zone"` || txt[1] != "second" {
+		t.Fatalf("got txt %q", txt)
+	}
+	if !zone.cuts["sub.lab.internal."] || !zone.names["b.deep.lab.internal."] {
+		t.Fatal("zone cut or empty non-terminal is missing")
+	}
+}
+
+func TestLoadZoneFileErrors(t *testing.T) {
+	testCases := map[string]string{
+		"no soa":         "$ORIGIN lab.internal.\nwww A 10.0.0.1\n",
+		"two soa":        "$ORIGIN lab.internal.\n@ SOA ns1 host 1 1 1 1 1\n@ SOA ns1 host 2 1 1 1 1\n",
+		"out of zone":    "$ORIGIN lab.internal.\n@ SOA ns1 host 1 1 1 1 1\nwww.example. A 10.0.0.1\n",
+		"unbalanced":     "$ORIGIN lab.internal.\n@ SOA ns1 host ( 1 1 1 1 1\n",
+		"unterminated":   "$ORIGIN lab.internal.\n@ SOA ns1 host 1 1 1 1 1\ntxt TXT \"open\n",
+		"include":        "$INCLUDE other.zone\n",
+		"chaos class":    "$ORIGIN lab.internal.\n@ CH SOA ns1 host 1 1 1 1 1\n",
+		"relative first": "www A 10.0.0.1\n",
+		"bad ttl":        "$TTL 1x\n",
+		"wrong a":        "$ORIGIN lab.internal.\n@ SOA ns1 host 1 1 1 1 1\nwww A 2001:db8::1\n",
+		"no owner":       "\tA 10.0.0.1\n",
+		"no type":        "$ORIGIN lab.internal.\n@ SOA ns1 host 1 1 1 1 1\nwww 300\n",
+	}
+	for name, content := range testCases {
+		if _, err := loadTestZone(t, content); err == nil {
+			t.Errorf("%s: zone loaded without error", name)
+		}
+	}
+}
+
+func TestZoneLookup(t *testing.T) {
+	zone, err := loadTestZone(t, testZoneFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		qType       dnsmessage.Type
+		rCode       dnsmessage.RCode
+		answers     []dnsmessage.Type
+		authorities []dnsmessage.Type
+	}{
+		{"www.lab.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Type{dnsmessage.TypeA}, nil},
+		{"WWW.Lab.Internal.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil, []dnsmessage.Type{dnsmessage.TypeSOA}},
+		{"alias.lab.internal.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []dnsmessage.Type{dnsmessage.TypeCNAME, dnsmessage.TypeAAAA}, nil},
+		{"x.wild.lab.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []dnsmessage.Type{dnsmessage.TypeA}, nil},
+		{"b.deep.lab.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []dnsmessage.Type{dnsmessage.TypeSOA}},
+		{"missing.lab.internal.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, []dnsmessage.Type{dnsmessage.TypeSOA}},
+		{"host.sub.lab.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []dnsmessage.Type{dnsmessage.TypeNS}},
+	}
+	for _, testCase := range testCases {
+		msg := zone.Lookup(testQuestion(testCase.name, testCase.qType))
+		if msg.Header.RCode != testCase.rCode || !sameTypes(msg.Answers, testCase.answers) || !sameTypes(msg.Authorities, testCase.authorities) {
+			t.Errorf("%s %s: got rcode %v answers %v authorities %v", testCase.name, testCase.qType, msg.Header.RCode, msg.Answers, msg.Authorities)
+		}
+	}
+	msg := zone.Lookup(testQuestion("x.wild.lab.internal.", dnsmessage.TypeA))
+	if owner := msg.Answers[0].Header.Name.String(); owner != "x.wild.lab.internal." {
+		t.Fatalf("wildcard answer has owner %s", owner)
+	}
+	msg = zone.Lookup(testQuestion("missing.lab.internal.", dnsmessage.TypeA))
+	if ttl := msg.Authorities[0].Header.TTL; ttl != 300 {
+		t.Fatalf("negative soa has ttl %d, want the soa minimum 300", ttl)
+	}
+	msg = zone.Lookup(testQuestion("host.sub.lab.internal.", dnsmessage.TypeA))
+	if msg.Header.Authoritative || len(msg.Additionals) != 1 || !strings.HasPrefix(msg.Additionals[0].Header.Name.String(), "ns.sub.") {
+		t.Fatalf("got referral %v, want glue for ns.sub", msg)
+	}
+}
+
+func sameTypes(resources []dnsmessage.Resource, types []dnsmessage.Type) bool {
+	if len(resources) != len(types) {
+		return false
+	}
+	for i := range resources {
+		if resources[i].Header.Type != types[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -52,6 +52,10 @@ func Init() error {
 	}
 	return nil
 }
+func Flush() {
+	Logger.Flush()
+}
+
 func Error(process string, objs ...interface{}) {
 	msg := "[" + GetCallerName(1) + "] {" + process + "} "
 	for _, obj := range objs {
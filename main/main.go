@@ -1,14 +1,25 @@
 package main
 
 import (
+	"accdns/acl"
+	"accdns/admin"
 	"accdns/cache"
 	"accdns/common"
 	"accdns/diversion"
+	"accdns/dnstap"
 	"accdns/logger"
+	"accdns/metrics"
 	"accdns/network"
+	"accdns/querylog"
+	"accdns/ratelimit"
+	"accdns/stats"
 	"flag"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var configFilePath = flag.String("c", "", "Config File Path")
@@ -19,36 +30,130 @@ func main() {
 	if *newConfigFilePath != "" {
 		if err := common.CreateConfigFile(*newConfigFilePath); err != nil {
 			logger.Error("Create Configuration File", err)
+			os.Exit(exitCodeStartFailed)
 		}
 		return
 	}
 	if err := common.Init(*configFilePath); err != nil {
 		logger.Error("Initialize", err)
-		return
+		os.Exit(exitCodeStartFailed)
 	}
 	if err := logger.Init(); err != nil {
 		logger.Error("Logger Initialize", err)
-		return
+		os.Exit(exitCodeStartFailed)
 	}
-	if err := network.Init(); err != nil {
-		logger.Error("Network Initialize", err)
-		return
+	if err := diversion.Init(); err != nil {
+		logger.Error("Diversion Initialize", err)
+		os.Exit(exitCodeStartFailed)
+	}
+	ratelimit.Init()
+	if err := querylog.Init(); err != nil {
+		logger.Error("Query Log Initialize", err)
+		os.Exit(exitCodeStartFailed)
+	}
+	if err := dnstap.Init(); err != nil {
+		logger.Error("Dnstap Initialize", err)
+		os.Exit(exitCodeStartFailed)
+	}
+	if err := stats.Init(); err != nil {
+		logger.Error("Stats Initialize", err)
+		os.Exit(exitCodeStartFailed)
 	}
 	waitGroup := sync.WaitGroup{}
 	var dnsCache *cache.Cache
 	if common.Config.Cache.EnableCache {
 		dnsCache = &cache.Cache{
-			MaxTTL: common.Config.Cache.MaxTTL,
-			MinTTL: common.Config.Cache.MinTTL,
+			MaxTTL:                   common.Config.Cache.MaxTTL,
+			MinTTL:                   common.Config.Cache.MinTTL,
+			ServeStale:               common.Config.Cache.ServeStale,
+			StaleTTL:                 common.Config.Cache.StaleTTL,
+			StaleAnswerTTL:           common.Config.Cache.StaleAnswerTTL,
+			StaleClientTimeoutMs:     common.Config.Cache.StaleClientTimeoutMs,
+			Prefetch:                 common.Config.Cache.Prefetch,
+			PrefetchMinHits:          common.Config.Cache.PrefetchMinHits,
+			PrefetchThresholdPercent: common.Config.Cache.PrefetchThresholdPercent,
+			Shards:                   common.Config.Cache.Shards,
+			MaxEntries:               common.Config.Cache.MaxEntries,
+		}
+		if common.Config.Cache.SnapshotFilePath != "" {
+			count, err := dnsCache.LoadSnapshot(common.Config.Cache.SnapshotFilePath)
+			if err != nil {
+				logger.Warning("Load Cache Snapshot", common.Config.Cache.SnapshotFilePath, err)
+			} else {
+				logger.Info("Load Cache Snapshot", "loaded", count, "entries from", common.Config.Cache.SnapshotFilePath)
+			}
+			if common.Config.Cache.SnapshotIntervalSec > 0 {
+				dnsCache.StartSnapshotLoop(common.Config.Cache.SnapshotFilePath, time.Duration(common.Config.Cache.SnapshotIntervalSec)*time.Second)
+			}
+		}
+	}
+	if dnsCache != nil {
+		metrics.RegisterCounterFunc("accdns_cache_hits_total", "Cache lookups answered with fresh entries.", func() float64 {
+			return float64(dnsCache.Hits())
+		})
+		metrics.RegisterCounterFunc("accdns_cache_stale_hits_total", "Cache lookups answered with stale entries.", func() float64 {
+			return float64(dnsCache.StaleHits())
+		})
+		metrics.RegisterCounterFunc("accdns_cache_misses_total", "Cache lookups sent to upstreams.", func() float64 {
+			return float64(dnsCache.Misses())
+		})
+		metrics.RegisterCounterFunc("accdns_cache_evictions_total", "Cache entries evicted to respect MaxEntries.", func() float64 {
+			return float64(dnsCache.Evictions())
+		})
+		metrics.RegisterGaugeFunc("accdns_cache_entries", "Number of cache entries.", func() float64 {
+			return float64(dnsCache.Len())
+		})
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			_ = reloadConfig()
+		}
+	}()
+	stopChan := make(chan struct{})
+	if dnsCache != nil && common.Config.Cache.WarmUpFilePath != "" {
+		warmUpDoneChan := make(chan struct{})
+		go func() {
+			defer close(warmUpDoneChan)
+			warmed, failed, err := diversion.WarmUp(common.Config.Cache.WarmUpFilePath, common.Config.Cache.WarmUpConcurrency, dnsCache, stopChan)
+			if err != nil {
+				logger.Warning("Warm Up Cache", common.Config.Cache.WarmUpFilePath, err)
+			}
+			logger.Info("Warm Up Cache", "warmed", warmed, "failed", failed)
+		}()
+		if common.Config.Cache.WarmUpBeforeListen {
+			select {
+			case <-warmUpDoneChan:
+			case sig := <-signalChan:
+				logger.Alert("General", "received signal", sig, "during cache warm up")
+				close(stopChan)
+				<-warmUpDoneChan
+				exitCode := flushOutputs(dnsCache)
+				logger.Alert("General", "AccDNS Stopped", "exit code", exitCode)
+				logger.Flush()
+				os.Exit(exitCode)
+			}
 		}
 	}
+	adminServer, err := admin.Start(dnsCache, reloadConfig)
+	if err != nil {
+		logger.Error("Admin Initialize", err)
+		os.Exit(exitCodeStartFailed)
+	}
+	inFlight := sync.WaitGroup{}
+	var udpListener *net.UDPConn
+	var tcpListener *net.TCPListener
 	if common.Config.Service.ListenUDP {
 		udpAddr, err := net.ResolveUDPAddr("udp", common.Config.Service.ListenAddr)
 		listener, err := net.ListenUDP("udp", udpAddr)
 		if err != nil {
 			logger.Error("Listen UDP", err)
-			return
+			os.Exit(exitCodeStartFailed)
 		}
+		udpListener = listener
 		logger.Alert("Listen UDP", "listen on", common.Config.Service.ListenAddr)
 		waitGroup.Add(1)
 		go func() {
@@ -60,24 +165,100 @@ func main() {
 				bufferBytes := make([]byte, common.Config.Advanced.MaxReceivedPacketSize)
 				n, addr, err := listener.ReadFromUDP(bufferBytes)
 				if err != nil {
+					select {
+					case <-stopChan:
+						return
+					default:
+					}
 					logger.Warning("Read UDP Packet", addr, err)
 					continue
 				}
+				receivedAt := time.Now()
 				if common.NeedDebug() {
 					logger.Debug("Read UDP Packet", bufferBytes)
 					logger.Debug("Read UDP Packet", "Read", n, "bytes from", addr)
 				}
+				dnstap.ClientQuery(addr, listener.LocalAddr(), bufferBytes[:n], receivedAt)
+				settings := diversion.Current()
+				action, policy := settings.ACL.Check(addr.IP)
+				if action != acl.ActionAllow {
+					metrics.ACLDecisions.Inc("udp", action)
+				}
+				if action == acl.ActionDeny {
+					if common.NeedDebug() {
+						logger.Debug("Deny UDP Packet", addr)
+					}
+					continue
+				}
+				switch ratelimit.AllowQuery(settings.Config, addr.IP, policy) {
+				case ratelimit.DecisionDrop:
+					metrics.RateLimitDecisions.Inc("query", "drop")
+					if common.NeedDebug() {
+						logger.Debug("Limit UDP Packet", addr)
+					}
+					continue
+				case ratelimit.DecisionSlip:
+					metrics.RateLimitDecisions.Inc("query", "slip")
+					inFlight.Add(1)
+					go func() {
+						defer inFlight.Done()
+						respBytes, err := diversion.SlipPacket(bufferBytes[:n], &diversion.Client{IP: addr.IP, Port: addr.Port, Transport: "udp", Policy: policy}, receivedAt)
+						if err != nil {
+							logger.Warning("Truncate DNS Packet", addr, err)
+							return
+						}
+						if _, err := listener.WriteToUDP(respBytes, addr); err != nil {
+							logger.Warning("Write UDP Packet", addr, err)
+						}
+						dnstap.ClientResponse(addr, listener.LocalAddr(), respBytes, receivedAt)
+					}()
+					continue
+				}
+				inFlight.Add(1)
 				go func() {
-					if err := diversion.HandlePacket(bufferBytes, func(respBytes []byte) {
+					defer inFlight.Done()
+					if action == acl.ActionRefuse {
+						respBytes, err := diversion.RefusePacket(bufferBytes[:n], &diversion.Client{IP: addr.IP, Port: addr.Port, Transport: "udp", Policy: policy}, receivedAt)
+						if err != nil {
+							logger.Warning("Refuse DNS Packet", addr, err)
+							return
+						}
+						if _, err := listener.WriteToUDP(respBytes, addr); err != nil {
+							logger.Warning("Write UDP Packet", addr, err)
+						}
+						dnstap.ClientResponse(addr, listener.LocalAddr(), respBytes, receivedAt)
+						return
+					}
+					if err := diversion.HandlePacket(settings, bufferBytes, func(respBytes []byte) string {
+						status := ""
+						switch ratelimit.AllowResponse(settings.Config, addr.IP, policy, respBytes) {
+						case ratelimit.DecisionDrop:
+							metrics.RateLimitDecisions.Inc("response", "drop")
+							if common.NeedDebug() {
+								logger.Debug("Limit UDP Response", addr)
+							}
+							return diversion.StatusDropped
+						case ratelimit.DecisionSlip:
+							metrics.RateLimitDecisions.Inc("response", "slip")
+							truncatedBytes, err := diversion.TruncatePacket(respBytes)
+							if err != nil {
+								logger.Warning("Truncate DNS Packet", addr, err)
+								return diversion.StatusDropped
+							}
+							respBytes = truncatedBytes
+							status = diversion.StatusSlipped
+						}
 						n, err := listener.WriteToUDP(respBytes, addr)
 						if err != nil {
 							logger.Warning("Write UDP Packet", addr, err)
 						}
+						dnstap.ClientResponse(addr, listener.LocalAddr(), respBytes, receivedAt)
 						if common.NeedDebug() {
 							logger.Debug("Write UDP Packet", respBytes)
 							logger.Debug("Write UDP Packet", "Write", n, "bytes to", addr)
 						}
-					}, dnsCache); err != nil {
+						return status
+					}, dnsCache, &diversion.Client{IP: addr.IP, Port: addr.Port, Transport: "udp", Policy: policy}); err != nil {
 						logger.Warning("Handle DNS Packet", addr, err)
 					}
 				}()
@@ -90,8 +271,9 @@ func main() {
 		listener, err := net.ListenTCP("tcp", tcpAddr)
 		if err != nil {
 			logger.Error("Listen TCP", err)
-			return
+			os.Exit(exitCodeStartFailed)
 		}
+		tcpListener = listener
 		logger.Alert("Listen TCP", "listen on", common.Config.Service.ListenAddr)
 		waitGroup.Add(1)
 		go func() {
@@ -102,10 +284,30 @@ func main() {
 				}
 				conn, err := listener.AcceptTCP()
 				if err != nil {
+					select {
+					case <-stopChan:
+						return
+					default:
+					}
 					logger.Error("Establish TCP Connection", err)
 					continue
 				}
+				remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+				settings := diversion.Current()
+				action, policy := settings.ACL.Check(remoteAddr.IP)
+				if action != acl.ActionAllow {
+					metrics.ACLDecisions.Inc("tcp", action)
+				}
+				if action == acl.ActionDeny {
+					if common.NeedDebug() {
+						logger.Debug("Deny TCP Connection", remoteAddr)
+					}
+					_ = conn.Close()
+					continue
+				}
+				inFlight.Add(1)
 				go func() {
+					defer inFlight.Done()
 					defer func() {
 						if err := conn.Close(); err != nil {
 							logger.Warning("Close TCP Connection", conn.RemoteAddr(), err)
@@ -114,21 +316,38 @@ func main() {
 					readBytes, n, err := network.ReadPacketFromTCPConn(conn)
 					if err != nil {
 						logger.Warning("Read DNS Packet from TCP Connection", conn.RemoteAddr(), err)
+						return
+					}
+					receivedAt := time.Now()
+					dnstap.ClientQuery(conn.RemoteAddr(), conn.LocalAddr(), readBytes, receivedAt)
+					if action == acl.ActionRefuse {
+						respBytes, err := diversion.RefusePacket(readBytes, &diversion.Client{IP: remoteAddr.IP, Port: remoteAddr.Port, Transport: "tcp", Policy: policy}, receivedAt)
+						if err != nil {
+							logger.Warning("Refuse DNS Packet", conn.RemoteAddr(), err)
+							return
+						}
+						if _, err := network.WritePacketToTCPConn(respBytes, conn); err != nil {
+							logger.Warning("Write DNS Packet to TCP Connection", conn.RemoteAddr(), err)
+						}
+						dnstap.ClientResponse(conn.RemoteAddr(), conn.LocalAddr(), respBytes, receivedAt)
+						return
 					}
 					if common.NeedDebug() {
 						logger.Debug("Read DNS Packet from TCP Connection", readBytes)
 						logger.Debug("Read DNS Packet from TCP Connection", "Read", n, "bytes from", conn.RemoteAddr())
 					}
-					if err = diversion.HandlePacket(readBytes, func(respBytes []byte) {
+					if err = diversion.HandlePacket(settings, readBytes, func(respBytes []byte) string {
 						n, err := network.WritePacketToTCPConn(respBytes, conn)
 						if err != nil {
 							logger.Warning("Write DNS Packet to TCP Connection", conn.RemoteAddr(), err)
 						}
+						dnstap.ClientResponse(conn.RemoteAddr(), conn.LocalAddr(), respBytes, receivedAt)
 						if common.NeedDebug() {
 							logger.Debug("Write DNS Packet to TCP Connection", respBytes)
 							logger.Debug("Write DNS Packet to TCP Connection", "Write", n, "bytes to", conn.RemoteAddr())
 						}
-					}, dnsCache); err != nil {
+						return ""
+					}, dnsCache, &diversion.Client{IP: remoteAddr.IP, Port: remoteAddr.Port, Transport: "tcp", Policy: policy}); err != nil {
 						logger.Warning("Handle DNS Packet", err)
 					}
 				}()
@@ -136,5 +355,30 @@ func main() {
 		}()
 	}
 	logger.Alert("General", "AccDNS Started")
+	sig := <-signalChan
+	logger.Alert("General", "received signal", sig)
+	close(stopChan)
+	if udpListener != nil {
+		_ = udpListener.SetReadDeadline(time.Now())
+	}
+	if tcpListener != nil {
+		_ = tcpListener.Close()
+	}
 	waitGroup.Wait()
+	shutdownTimeout := time.Duration(common.Config.Service.ShutdownTimeoutSec) * time.Second
+	adminDoneChan := shutdownAdmin(adminServer, shutdownTimeout)
+	exitCode := drainQueries(&inFlight, shutdownTimeout, signalChan)
+	if udpListener != nil {
+		_ = udpListener.Close()
+	}
+	if adminServer != nil && exitCode != exitCodeOK {
+		_ = adminServer.Close()
+	}
+	<-adminDoneChan
+	if code := flushOutputs(dnsCache); code != exitCodeOK {
+		exitCode = code
+	}
+	logger.Alert("General", "AccDNS Stopped", "exit code", exitCode)
+	logger.Flush()
+	os.Exit(exitCode)
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"accdns/common"
+	"accdns/diversion"
+	"accdns/logger"
+	"reflect"
+)
+
+func reloadConfig() error {
+	logger.Alert("Reload Configuration", "read", *configFilePath)
+	newConfig, err := common.Load(*configFilePath)
+	if err != nil {
+		logger.Error("Reload Configuration", err)
+		return err
+	}
+	keepRestartOnlySections(common.Config, newConfig)
+	if err := diversion.Reload(newConfig); err != nil {
+		logger.Error("Reload Configuration", err)
+		return err
+	}
+	logger.Alert("Reload Configuration", "AccDNS Reloaded")
+	return nil
+}
+
+func keepRestartOnlySections(oldConfig *common.ConfigStruct, newConfig *common.ConfigStruct) {
+	if !reflect.DeepEqual(oldConfig.Service, newConfig.Service) {
+		logger.Warning("Reload Configuration", "changes of [Service] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Cache, newConfig.Cache) {
+		logger.Warning("Reload Configuration", "changes of [Cache] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.QueryLog, newConfig.QueryLog) {
+		logger.Warning("Reload Configuration", "changes of [QueryLog] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Dnstap, newConfig.Dnstap) {
+		logger.Warning("Reload Configuration", "changes of [Dnstap] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Stats, newConfig.Stats) {
+		logger.Warning("Reload Configuration", "changes of [Stats] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Log, newConfig.Log) {
+		logger.Warning("Reload Configuration", "changes of [Log] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Admin, newConfig.Admin) {
+		logger.Warning("Reload Configuration", "changes of [Admin] need a restart")
+	}
+	if !reflect.DeepEqual(oldConfig.Advanced, newConfig.Advanced) {
+		logger.Warning("Reload Configuration", "changes of [Advanced] need a restart")
+	}
+	newConfig.Service = oldConfig.Service
+	newConfig.Cache = oldConfig.Cache
+	newConfig.QueryLog = oldConfig.QueryLog
+	newConfig.Dnstap = oldConfig.Dnstap
+	newConfig.Stats = oldConfig.Stats
+	newConfig.Log = oldConfig.Log
+	newConfig.Admin = oldConfig.Admin
+	newConfig.Advanced = oldConfig.Advanced
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"accdns/admin"
+	"accdns/cache"
+	"accdns/common"
+	"accdns/dnstap"
+	"accdns/logger"
+	"accdns/querylog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	exitCodeOK             = 0
+	exitCodeStartFailed    = 1
+	exitCodeDrainTimeout   = 2
+	exitCodeSnapshotFailed = 3
+)
+
+func drainQueries(inFlight *sync.WaitGroup, timeout time.Duration, signalChan chan os.Signal) int {
+	drainedChan := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drainedChan)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drainedChan:
+		logger.Info("Shutdown", "all in-flight queries finished")
+		return exitCodeOK
+	case <-timer.C:
+		logger.Warning("Shutdown", "abandon in-flight queries after", timeout)
+		return exitCodeDrainTimeout
+	case sig := <-signalChan:
+		logger.Warning("Shutdown", "received signal", sig, "again, abandon in-flight queries")
+		return exitCodeDrainTimeout
+	}
+}
+
+func shutdownAdmin(adminServer *admin.Server, timeout time.Duration) chan struct{} {
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		if adminServer == nil {
+			return
+		}
+		if err := adminServer.Shutdown(timeout); err != nil {
+			logger.Warning("Shutdown", "admin server", err)
+		}
+	}()
+	return doneChan
+}
+
+func flushOutputs(dnsCache *cache.Cache) int {
+	exitCode := exitCodeOK
+	if dnsCache != nil && common.Config.Cache.SnapshotFilePath != "" {
+		count, err := dnsCache.SaveSnapshot(common.Config.Cache.SnapshotFilePath)
+		if err != nil {
+			logger.Error("Save Cache Snapshot", common.Config.Cache.SnapshotFilePath, err)
+			exitCode = exitCodeSnapshotFailed
+		} else {
+			logger.Info("Save Cache Snapshot", "saved", count, "entries to", common.Config.Cache.SnapshotFilePath)
+		}
+	}
+	querylog.Close()
+	dnstap.Close()
+	return exitCode
+}
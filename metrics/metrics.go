@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var registryMutex sync.Mutex
+var registry = make([]collector, 0)
+var inFlight int64
+
+var Queries = NewCounterVec("accdns_queries_total", "Client queries by listener, question type and response code.", "listener", "type", "rcode")
+var ACLDecisions = NewCounterVec("accdns_acl_decisions_total", "Client packets or connections denied or refused by ACL rules.", "listener", "action")
+var RateLimitDecisions = NewCounterVec("accdns_ratelimit_decisions_total", "UDP queries and responses dropped or slipped by rate limiting.", "kind", "decision")
+var RateLimitEvictions = NewCounterVec("accdns_ratelimit_evictions_total", "Rate limit buckets evicted because the table was full.", "kind")
+var FilterDecisions = NewCounterVec("accdns_filter_decisions_total", "Questions answered by filter lists or local records.", "decision")
+var UpstreamRequests = NewCounterVec("accdns_upstream_requests_total", "Requests sent to upstreams.", "upstream")
+var UpstreamErrors = NewCounterVec("accdns_upstream_errors_total", "Requests to upstreams that failed.", "upstream")
+var UpstreamLatency = NewHistogramVec("accdns_upstream_request_duration_seconds", "Latency of successful upstream requests.", defaultBuckets, "upstream")
+var DNSSECValidations = NewCounterVec("accdns_dnssec_validations_total", "Upstream responses validated with DNSSEC by result.", "result")
+
+func init() {
+	RegisterGaugeFunc("accdns_inflight_queries", "Client queries being handled.", func() float64 {
+		return float64(atomic.LoadInt64(&inFlight))
+	})
+	RegisterGaugeFunc("accdns_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+}
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, c)
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	vec := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+	register(vec)
+	return vec
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	vec := &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+	register(vec)
+	return vec
+}
+
+func RegisterCounterFunc(name string, help string, value func() float64) {
+	register(&funcMetric{name: name, help: help, metricType: "counter", value: value})
+}
+
+func RegisterGaugeFunc(name string, help string, value func() float64) {
+	register(&funcMetric{name: name, help: help, metricType: "gauge", value: value})
+}
+
+func BeginQuery() {
+	atomic.AddInt64(&inFlight, 1)
+}
+
+func EndQuery() {
+	atomic.AddInt64(&inFlight, -1)
+}
+
+func (vec *CounterVec) Inc(labelValues ...string) {
+	vec.Add(1, labelValues...)
+}
+
+func (vec *CounterVec) Add(delta uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	value := vec.values[key]
+	if value == nil {
+		value = &counterValue{labelValues: labelValues}
+		vec.values[key] = value
+	}
+	value.value += delta
+}
+
+func (vec *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	value := vec.values[key]
+	if value == nil {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(vec.buckets))}
+		vec.values[key] = value
+	}
+	for i, bound := range vec.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += v
+}
+
+func Text() []byte {
+	registryMutex.Lock()
+	collectors := make([]collector, len(registry))
+	copy(collectors, registry)
+	registryMutex.Unlock()
+	builder := &textBuilder{lines: make([]byte, 0, 4096)}
+	for _, c := range collectors {
+		c.write(builder)
+	}
+	return builder.lines
+}
+
+func (vec *CounterVec) write(builder *textBuilder) {
+	builder.header(vec.name, vec.help, "counter")
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := vec.values[key]
+		builder.sample(vec.name, vec.labelNames, value.labelValues, "", "", float64(value.value))
+	}
+}
+
+func (vec *HistogramVec) write(builder *textBuilder) {
+	builder.header(vec.name, vec.help, "histogram")
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := vec.values[key]
+		for i, bound := range vec.buckets {
+			builder.sample(vec.name+"_bucket", vec.labelNames, value.labelValues, "le", formatFloat(bound), float64(value.counts[i]))
+		}
+		builder.sample(vec.name+"_bucket", vec.labelNames, value.labelValues, "le", "+Inf", float64(value.count))
+		builder.sample(vec.name+"_sum", vec.labelNames, value.labelValues, "", "", value.sum)
+		builder.sample(vec.name+"_count", vec.labelNames, value.labelValues, "", "", float64(value.count))
+	}
+}
+
+func (metric *funcMetric) write(builder *textBuilder) {
+	builder.header(metric.name, metric.help, metric.metricType)
+	builder.sample(metric.name, nil, nil, "", "", metric.value())
+}
+
+func (builder *textBuilder) header(name string, help string, metricType string) {
+	builder.lines = append(builder.lines, "# HELP "+name+" "+help+"\n# TYPE "+name+" "+metricType+"\n"...)
+}
+
+func (builder *textBuilder) sample(name string, labelNames []string, labelValues []string, extraName string, extraValue string, value float64) {
+	builder.lines = append(builder.lines, name...)
+	labels := make([]string, 0, len(labelNames)+1)
+	for i, labelName := range labelNames {
+		if i < len(labelValues) {
+			labels = append(labels, labelName+"=\""+escapeLabel(labelValues[i])+"\"")
+		}
+	}
+	if extraName != "" {
+		labels = append(labels, extraName+"=\""+extraValue+"\"")
+	}
+	if len(labels) > 0 {
+		builder.lines = append(builder.lines, "{"+strings.Join(labels, ",")+"}"...)
+	}
+	builder.lines = append(builder.lines, " "+formatFloat(value)+"\n"...)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterVecText(t *testing.T) {
+	vec := &CounterVec{name: "test_queries_total", help: "Test queries.", labelNames: []string{"listener", "rcode"}, values: make(map[string]*counterValue)}
+	vec.Inc("udp", "NOERROR")
+	vec.Add(2, "udp", "NOERROR")
+	vec.Inc("tcp", "quote\"back\\slash\nline")
+	builder := &textBuilder{}
+	vec.write(builder)
+	want := "# HELP test_queries_total Test queries.\n" +
+		"# TYPE test_queries_total counter\n" +
+		"test_queries_total{listener=\"tcp\",rcode=\"quote\\\"back\\\\slash\\nline\"} 1\n" +
+		"test_queries_total{listener=\"udp\",rcode=\"NOERROR\"} 3\n"
+	if text := string(builder.lines); text != want {
+		t.Fatalf("got\n%s\nwant\n%s", text, want)
+	}
+}
+
+func TestHistogramVecText(t *testing.T) {
+	vec := &HistogramVec{name: "test_latency_seconds", help: "Test latency.", labelNames: []string{"upstream"}, buckets: []float64{0.01, 0.1}, values: make(map[string]*histogramValue)}
+	vec.Observe(0.005, "a")
+	vec.Observe(0.05, "a")
+	vec.Observe(0.5, "a")
+	builder := &textBuilder{}
+	vec.write(builder)
+	want := "# HELP test_latency_seconds Test latency.\n" +
+		"# TYPE test_latency_seconds histogram\n" +
+		"test_latency_seconds_bucket{upstream=\"a\",le=\"0.01\"} 1\n" +
+		"test_latency_seconds_bucket{upstream=\"a\",le=\"0.1\"} 2\n" +
+		"test_latency_seconds_bucket{upstream=\"a\",le=\"+Inf\"} 3\n" +
+		"test_latency_seconds_sum{upstream=\"a\"} 0.555\n" +
+		"test_latency_seconds_count{upstream=\"a\"} 3\n"
+	if text := string(builder.lines); text != want {
+		t.Fatalf("got\n%s\nwant\n%s", text, want)
+	}
+}
+
+func TestTextIncludesRegisteredMetrics(t *testing.T) {
+	RegisterCounterFunc("test_func_total", "Test counter func.", func() float64 { return 42 })
+	BeginQuery()
+	BeginQuery()
+	EndQuery()
+	defer EndQuery()
+	text := string(Text())
+	for _, line := range []string{
+		"# TYPE test_func_total counter\ntest_func_total 42\n",
+		"# TYPE accdns_inflight_queries gauge\naccdns_inflight_queries 1\n",
+		"# TYPE accdns_queries_total counter\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("text does not contain %q", line)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"sync"
+)
+
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       uint64
+}
+
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+type funcMetric struct {
+	name       string
+	help       string
+	metricType string
+	value      func() float64
+}
+
+type collector interface {
+	write(builder *textBuilder)
+}
+
+type textBuilder struct {
+	lines []byte
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+var v4MappedRange = cidrRange{
+	start: [16]byte{10: 0xff, 11: 0xff},
+	end:   [16]byte{10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff},
+}
+
+func ParseCIDRSet(entries []string) (*CIDRSet, error) {
+	set := &CIDRSet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if err := set.AddCIDR(entry); err != nil {
+			if err := set.LoadFile(entry); err != nil {
+				return nil, errors.New("\"" + entry + "\" is neither a cidr nor a readable cidr list file")
+			}
+		}
+	}
+	set.Build()
+	return set, nil
+}
+
+func (set *CIDRSet) LoadFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index >= 0 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := set.AddCIDR(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (set *CIDRSet) AddCIDR(cidr string) error {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return errors.New("wrong cidr " + cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	start := ipNet.IP.To16()
+	end := make(net.IP, net.IPv6len)
+	copy(end, start)
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		for i := 0; i < net.IPv4len; i++ {
+			end[12+i] |= ^mask[i]
+		}
+	} else {
+		for i := 0; i < net.IPv6len; i++ {
+			end[i] |= ^mask[i]
+		}
+	}
+	ipRange := cidrRange{}
+	copy(ipRange.start[:], start)
+	copy(ipRange.end[:], end)
+	if ones, _ := mask.Size(); len(mask) == net.IPv6len && ones < 96 && bytes.Compare(ipRange.start[:], v4MappedRange.start[:]) <= 0 && bytes.Compare(ipRange.end[:], v4MappedRange.end[:]) >= 0 {
+		set.ranges = append(set.ranges, cidrRange{start: ipRange.start, end: [16]byte{10: 0xff, 11: 0xfe, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff}})
+		if ipRange.end != v4MappedRange.end {
+			set.ranges = append(set.ranges, cidrRange{start: [16]byte{9: 1}, end: ipRange.end})
+		}
+		return nil
+	}
+	set.ranges = append(set.ranges, ipRange)
+	return nil
+}
+
+func (set *CIDRSet) Build() {
+	sort.Slice(set.ranges, func(i, j int) bool {
+		return bytes.Compare(set.ranges[i].start[:], set.ranges[j].start[:]) < 0
+	})
+	merged := make([]cidrRange, 0, len(set.ranges))
+	for _, ipRange := range set.ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if bytes.Compare(ipRange.start[:], last.end[:]) <= 0 || isNextIP(last.end, ipRange.start) {
+				if bytes.Compare(ipRange.end[:], last.end[:]) > 0 {
+					last.end = ipRange.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, ipRange)
+	}
+	set.ranges = merged
+}
+
+func (set *CIDRSet) Contains(ip net.IP) bool {
+	if set == nil {
+		return false
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	index := sort.Search(len(set.ranges), func(i int) bool {
+		return bytes.Compare(set.ranges[i].end[:], ip16) >= 0
+	})
+	return index < len(set.ranges) && bytes.Compare(set.ranges[index].start[:], ip16) <= 0
+}
+
+func (set *CIDRSet) Len() int {
+	if set == nil {
+		return 0
+	}
+	return len(set.ranges)
+}
+
+func isNextIP(a [16]byte, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a == b
+}
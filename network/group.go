@@ -0,0 +1,111 @@
+package network
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"strconv"
+	"strings"
+)
+
+func GroupName(typeCode dnsmessage.Type) string {
+	if typeCode == dnsmessage.Type(0) {
+		return "default"
+	}
+	name := strings.TrimPrefix(typeCode.String(), "Type")
+	if _, err := strconv.Atoi(name); err == nil {
+		return "TYPE" + name
+	}
+	return name
+}
+
+func (upstreams *Upstreams) initGroups(config *common.ConfigStruct) error {
+	for typeCode, typeUpstreams := range upstreams.List {
+		if len(typeUpstreams) > 0 || typeCode == 0 {
+			upstreams.Groups[GroupName(dnsmessage.Type(typeCode))] = typeUpstreams
+		}
+	}
+	for _, kvPair := range config.Upstream.GroupUpstreams {
+		groupName, addr, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return err
+		}
+		if _, err := common.ParseRecordType(groupName); err == nil || groupName == "default" {
+			return errors.New("upstream group name \"" + groupName + "\" is reserved")
+		}
+		socketAddr, err := ParseNewSocketAddr(addr)
+		if err != nil {
+			return err
+		}
+		logger.Info("Load Upstream For Group "+groupName, socketAddr.String())
+		upstreams.Groups[groupName] = append(upstreams.Groups[groupName], socketAddr)
+	}
+	blacklists, err := parseGroupEntries(config.Upstream.GroupIPBlacklist)
+	if err != nil {
+		return err
+	}
+	allowlists, err := parseGroupEntries(config.Upstream.GroupIPAllowlist)
+	if err != nil {
+		return err
+	}
+	fallbacks, err := parseGroupEntries(config.Upstream.GroupFallback)
+	if err != nil {
+		return err
+	}
+	for groupName := range upstreams.Groups {
+		if blacklists[groupName] == nil && allowlists[groupName] == nil && fallbacks[groupName] == nil {
+			continue
+		}
+		ipFilter := &GroupIPFilter{}
+		if entries := blacklists[groupName]; entries != nil {
+			if ipFilter.Blacklist, err = ParseCIDRSet(entries); err != nil {
+				return err
+			}
+		}
+		if entries := allowlists[groupName]; entries != nil {
+			if ipFilter.Allowlist, err = ParseCIDRSet(entries); err != nil {
+				return err
+			}
+		}
+		if entries := fallbacks[groupName]; entries != nil {
+			if len(entries) != 1 {
+				return errors.New("upstream group \"" + groupName + "\" has more than one fallback group")
+			}
+			ipFilter.Fallback = entries[0]
+		}
+		logger.Info("Load IP Filter For Group "+groupName, "blacklist", ipFilter.Blacklist.Len(), "ranges", "allowlist", ipFilter.Allowlist.Len(), "ranges", "fallback", ipFilter.Fallback)
+		upstreams.IPFilters[groupName] = ipFilter
+	}
+	for groupName, entries := range blacklists {
+		if _, ok := upstreams.Groups[groupName]; !ok {
+			return errors.New("upstream group \"" + groupName + "\" of ip blacklist " + strings.Join(entries, ",") + " does not exist")
+		}
+	}
+	for groupName, entries := range allowlists {
+		if _, ok := upstreams.Groups[groupName]; !ok {
+			return errors.New("upstream group \"" + groupName + "\" of ip allowlist " + strings.Join(entries, ",") + " does not exist")
+		}
+	}
+	for groupName, entries := range fallbacks {
+		if _, ok := upstreams.Groups[groupName]; !ok {
+			return errors.New("upstream group \"" + groupName + "\" does not exist")
+		}
+		if _, ok := upstreams.Groups[entries[0]]; !ok {
+			return errors.New("fallback upstream group \"" + entries[0] + "\" does not exist")
+		}
+	}
+	return nil
+}
+
+func parseGroupEntries(kvPairs []string) (map[string][]string, error) {
+	entries := make(map[string][]string)
+	for _, kvPair := range kvPairs {
+		groupName, value, err := common.ParseKVPair(kvPair)
+		if err != nil {
+			return nil, err
+		}
+		entries[groupName] = append(entries[groupName], value)
+	}
+	return entries, nil
+}
@@ -13,96 +13,102 @@ import (
 	"strings"
 )
 
-var UpstreamsList [256][]*SocketAddr
-
-func Init() error {
-	for typeCode := range UpstreamsList {
+func LoadUpstreams(config *common.ConfigStruct) (*Upstreams, error) {
+	upstreams := &Upstreams{
+		Groups:    make(map[string][]*SocketAddr),
+		IPFilters: make(map[string]*GroupIPFilter),
+	}
+	for typeCode := range upstreams.List {
 		switch dnsmessage.Type(typeCode) {
 		case dnsmessage.Type(0):
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.DefaultUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.DefaultUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.DefaultUpstreams))
+			for i, upstreamStr := range config.Upstream.DefaultUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Info("Load Default Upstream", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		case dnsmessage.TypeA:
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.ARecordUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.ARecordUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.ARecordUpstreams))
+			for i, upstreamStr := range config.Upstream.ARecordUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Info("Load Upstream For A Record", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		case dnsmessage.TypeAAAA:
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.AAAARecordUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.AAAARecordUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.AAAARecordUpstreams))
+			for i, upstreamStr := range config.Upstream.AAAARecordUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Info("Load Upstream For AAAA Record", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		case dnsmessage.TypeCNAME:
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.CNAMERecordUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.CNAMERecordUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.CNAMERecordUpstreams))
+			for i, upstreamStr := range config.Upstream.CNAMERecordUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Info("Load Upstream For CNAME Record", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		case dnsmessage.TypeTXT:
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.TXTRecordUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.TXTRecordUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.TXTRecordUpstreams))
+			for i, upstreamStr := range config.Upstream.TXTRecordUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Debug("Load Upstream For TXT Record", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		case dnsmessage.TypePTR:
-			UpstreamsList[typeCode] = make([]*SocketAddr, len(common.Config.Upstream.PTRRecordUpstreams))
-			for i, upstreamStr := range common.Config.Upstream.PTRRecordUpstreams {
+			upstreams.List[typeCode] = make([]*SocketAddr, len(config.Upstream.PTRRecordUpstreams))
+			for i, upstreamStr := range config.Upstream.PTRRecordUpstreams {
 				socketAddr, err := ParseNewSocketAddr(upstreamStr)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				logger.Debug("Load Upstream For PTR Record", socketAddr.String())
-				UpstreamsList[typeCode][i] = socketAddr
+				upstreams.List[typeCode][i] = socketAddr
 			}
 		default:
-			UpstreamsList[typeCode] = make([]*SocketAddr, 0)
+			upstreams.List[typeCode] = make([]*SocketAddr, 0)
 		}
 	}
-	for _, kvPair := range common.Config.Upstream.CustomRecordUpstream {
+	for _, kvPair := range config.Upstream.CustomRecordUpstream {
 		typeCodeStr, addr, err := common.ParseKVPair(kvPair)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		typeCode, err := strconv.Atoi(typeCodeStr)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if typeCode < 0 || typeCode > 255 {
-			return errors.New("type code is not correct")
+			return nil, errors.New("type code is not correct")
 		}
 		socketAddr, err := ParseNewSocketAddr(addr)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		UpstreamsList[typeCode] = append(UpstreamsList[typeCode], socketAddr)
+		upstreams.List[typeCode] = append(upstreams.List[typeCode], socketAddr)
 	}
 
-	return nil
+	if err := upstreams.initGroups(config); err != nil {
+		return nil, err
+	}
+	return upstreams, nil
 }
+
 func ParseNewSocketAddr(addrStr string) (*SocketAddr, error) {
 	socketAddr := &SocketAddr{
 		UDPAddr: nil,
@@ -9,6 +9,12 @@ type SocketAddr struct {
 	TCPAddr *net.TCPAddr
 }
 
+type Upstreams struct {
+	List      [256][]*SocketAddr
+	Groups    map[string][]*SocketAddr
+	IPFilters map[string]*GroupIPFilter
+}
+
 type SocketConn struct {
 	SocketAddr *SocketAddr
 	UDPConn    *net.UDPConn
@@ -16,3 +22,17 @@ type SocketConn struct {
 	deadTime   int64
 	closed     bool
 }
+
+type CIDRSet struct {
+	ranges []cidrRange
+}
+type cidrRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+type GroupIPFilter struct {
+	Blacklist *CIDRSet
+	Allowlist *CIDRSet
+	Fallback  string
+}
@@ -0,0 +1,41 @@
+package querylog
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+)
+
+func FormatAnswers(resources []dnsmessage.Resource) []string {
+	answers := make([]string, 0, len(resources))
+	for _, res := range resources {
+		answers = append(answers, formatResource(res))
+	}
+	return answers
+}
+
+func formatResource(res dnsmessage.Resource) string {
+	prefix := res.Header.Name.String() + " " + strconv.FormatUint(uint64(res.Header.TTL), 10) + " " + strings.TrimPrefix(res.Header.Type.String(), "Type")
+	switch body := res.Body.(type) {
+	case *dnsmessage.AResource:
+		return prefix + " " + net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return prefix + " " + net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return prefix + " " + body.CNAME.String()
+	case *dnsmessage.NSResource:
+		return prefix + " " + body.NS.String()
+	case *dnsmessage.PTRResource:
+		return prefix + " " + body.PTR.String()
+	case *dnsmessage.MXResource:
+		return prefix + " " + strconv.Itoa(int(body.Pref)) + " " + body.MX.String()
+	case *dnsmessage.SRVResource:
+		return prefix + " " + strconv.Itoa(int(body.Priority)) + " " + strconv.Itoa(int(body.Weight)) + " " + strconv.Itoa(int(body.Port)) + " " + body.Target.String()
+	case *dnsmessage.TXTResource:
+		return prefix + " " + strconv.Quote(strings.Join(body.TXT, ""))
+	case *dnsmessage.SOAResource:
+		return prefix + " " + body.NS.String() + " " + body.MBox.String() + " " + strconv.FormatUint(uint64(body.Serial), 10)
+	}
+	return prefix
+}
@@ -0,0 +1,167 @@
+package querylog
+
+import (
+	"accdns/common"
+	"accdns/logger"
+	"accdns/metrics"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var entryChan chan *Entry
+var doneChan chan bool
+var closeMutex sync.RWMutex
+var closed bool
+var dropped uint64
+
+var file *os.File
+var writer *bufio.Writer
+var fileSize int64
+
+func Init() error {
+	if !common.Config.QueryLog.EnableQueryLog {
+		return nil
+	}
+	if common.Config.QueryLog.FilePath == "" {
+		return errors.New("query log file path is empty")
+	}
+	if common.Config.QueryLog.MaxBackups < 0 {
+		return errors.New("query log max backups " + strconv.Itoa(common.Config.QueryLog.MaxBackups) + " is not correct")
+	}
+	if common.Config.QueryLog.BufferSize < 1 {
+		return errors.New("query log buffer size " + strconv.Itoa(common.Config.QueryLog.BufferSize) + " is not correct")
+	}
+	if err := openFile(); err != nil {
+		return err
+	}
+	entryChan = make(chan *Entry, common.Config.QueryLog.BufferSize)
+	doneChan = make(chan bool)
+	metrics.RegisterCounterFunc("accdns_query_log_dropped_total", "Query log entries dropped because the buffer was full.", func() float64 {
+		return float64(atomic.LoadUint64(&dropped))
+	})
+	go writeLoop()
+	return nil
+}
+
+func Enabled() bool {
+	return entryChan != nil
+}
+
+func Log(entry *Entry) {
+	if entryChan == nil {
+		return
+	}
+	closeMutex.RLock()
+	defer closeMutex.RUnlock()
+	if closed {
+		return
+	}
+	select {
+	case entryChan <- entry:
+	default:
+		atomic.AddUint64(&dropped, 1)
+	}
+}
+
+func Close() {
+	if entryChan == nil {
+		return
+	}
+	closeMutex.Lock()
+	if closed {
+		closeMutex.Unlock()
+		return
+	}
+	closed = true
+	close(entryChan)
+	closeMutex.Unlock()
+	<-doneChan
+}
+
+func writeLoop() {
+	defer close(doneChan)
+	for entry := range entryChan {
+		bytes, err := json.Marshal(entry)
+		if err != nil {
+			logger.Warning("Encode Query Log", err)
+			continue
+		}
+		bytes = append(bytes, '\n')
+		if common.Config.QueryLog.MaxSizeKB > 0 && fileSize > 0 && fileSize+int64(len(bytes)) > common.Config.QueryLog.MaxSizeKB*1024 {
+			if err := rotate(); err != nil {
+				logger.Error("Rotate Query Log", err)
+			}
+		}
+		if writer == nil {
+			continue
+		}
+		n, err := writer.Write(bytes)
+		fileSize += int64(n)
+		if err != nil {
+			logger.Warning("Write Query Log", err)
+		}
+		if len(entryChan) == 0 {
+			if err := writer.Flush(); err != nil {
+				logger.Warning("Write Query Log", err)
+			}
+		}
+	}
+	closeFile()
+}
+
+func openFile() error {
+	var err error
+	file, err = os.OpenFile(common.Config.QueryLog.FilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		file = nil
+		return err
+	}
+	fileSize = info.Size()
+	writer = bufio.NewWriter(file)
+	return nil
+}
+
+func closeFile() {
+	if file == nil {
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		logger.Warning("Write Query Log", err)
+	}
+	if err := file.Close(); err != nil {
+		logger.Warning("Close Query Log", err)
+	}
+	file = nil
+	writer = nil
+}
+
+func rotate() error {
+	closeFile()
+	filePath := common.Config.QueryLog.FilePath
+	maxBackups := common.Config.QueryLog.MaxBackups
+	if maxBackups == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(filePath+"."+strconv.Itoa(i), filePath+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(filePath, filePath+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return openFile()
+}
@@ -0,0 +1,118 @@
+package querylog
+
+import (
+	"accdns/common"
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func startTestLog(t *testing.T, maxSizeKB int64, maxBackups int) string {
+	filePath := filepath.Join(t.TempDir(), "query.log")
+	oldConfig := common.Config.QueryLog
+	common.Config.QueryLog = &common.QueryLogConfig{EnableQueryLog: true, FilePath: filePath, MaxSizeKB: maxSizeKB, MaxBackups: maxBackups, BufferSize: 1000}
+	entryChan = nil
+	closed = false
+	t.Cleanup(func() {
+		Close()
+		common.Config.QueryLog = oldConfig
+		entryChan = nil
+	})
+	return filePath
+}
+
+func logTestEntries(t *testing.T, count int) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		Log(&Entry{Time: "2024-01-01T00:00:00Z", Client: "192.0.2.1:53000", Transport: "udp", Name: "host" + strconv.Itoa(i) + ".example.", Type: "A", Class: "IN", RCode: "NOERROR", Cache: "miss"})
+	}
+	Close()
+}
+
+func readTestLog(t *testing.T, filePath string) []Entry {
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRotateKeepsBackups(t *testing.T) {
+	filePath := startTestLog(t, 1, 2)
+	logTestEntries(t, 40)
+	lastIndex := -1
+	for _, path := range []string{filePath + ".2", filePath + ".1", filePath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Fatalf("%s has %d bytes, want at most 1024", path, info.Size())
+		}
+		entries := readTestLog(t, path)
+		if len(entries) == 0 {
+			t.Fatalf("%s is empty", path)
+		}
+		for _, entry := range entries {
+			index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(entry.Name, "host"), ".example."))
+			if err != nil || (lastIndex >= 0 && index != lastIndex+1) {
+				t.Fatalf("got entry %s after host%d", entry.Name, lastIndex)
+			}
+			if lastIndex < 0 && index == 0 {
+				t.Fatal("oldest backup was not removed")
+			}
+			lastIndex = index
+		}
+	}
+	if lastIndex != 39 {
+		t.Fatalf("last entry is host%d, want host39", lastIndex)
+	}
+	if _, err := os.Stat(filePath + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("third backup exists (%v)", err)
+	}
+}
+
+func TestRotateWithoutBackups(t *testing.T) {
+	filePath := startTestLog(t, 1, 0)
+	logTestEntries(t, 20)
+	if _, err := os.Stat(filePath + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("backup exists (%v)", err)
+	}
+	entries := readTestLog(t, filePath)
+	if len(entries) == 0 || len(entries) >= 20 || entries[len(entries)-1].Name != "host19.example." {
+		t.Fatalf("got %d entries, want only the newest ones", len(entries))
+	}
+}
+
+func TestRotateCountsExistingFile(t *testing.T) {
+	filePath := startTestLog(t, 1, 1)
+	if err := os.WriteFile(filePath, []byte(strings.Repeat("x", 1000)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logTestEntries(t, 1)
+	backup, err := os.ReadFile(filePath + ".1")
+	if err != nil || len(backup) != 1001 {
+		t.Fatalf("backup has %d bytes (%v), want the old file", len(backup), err)
+	}
+	if entries := readTestLog(t, filePath); len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+}
@@ -0,0 +1,15 @@
+package querylog
+
+type Entry struct {
+	Time      string   `json:"time"`
+	Client    string   `json:"client"`
+	Transport string   `json:"transport"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Class     string   `json:"class"`
+	RCode     string   `json:"rcode"`
+	Answers   []string `json:"answers"`
+	Upstreams []string `json:"upstreams"`
+	Cache     string   `json:"cache"`
+	LatencyMs float64  `json:"latency_ms"`
+}
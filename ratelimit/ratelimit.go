@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"accdns/acl"
+	"accdns/common"
+	"accdns/metrics"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DecisionPass Decision = iota
+	DecisionDrop
+	DecisionSlip
+)
+
+var queryLimiter = &Limiter{kind: "query", buckets: make(map[string]*bucket)}
+var responseLimiter = &Limiter{kind: "response", buckets: make(map[string]*bucket)}
+
+func Init() {
+	go cleanLoop(time.Minute)
+}
+
+func Validate(config *common.ConfigStruct) error {
+	if !config.RateLimit.EnableRateLimit {
+		return nil
+	}
+	if config.RateLimit.IPv4PrefixLen < 0 || config.RateLimit.IPv4PrefixLen > 32 {
+		return errors.New("ipv4 prefix length " + strconv.Itoa(config.RateLimit.IPv4PrefixLen) + " is not correct")
+	}
+	if config.RateLimit.IPv6PrefixLen < 0 || config.RateLimit.IPv6PrefixLen > 128 {
+		return errors.New("ipv6 prefix length " + strconv.Itoa(config.RateLimit.IPv6PrefixLen) + " is not correct")
+	}
+	if config.RateLimit.Slip < 0 {
+		return errors.New("slip " + strconv.Itoa(config.RateLimit.Slip) + " is not correct")
+	}
+	if config.RateLimit.MaxBuckets < 1 {
+		return errors.New("max buckets " + strconv.Itoa(config.RateLimit.MaxBuckets) + " is not correct")
+	}
+	return nil
+}
+
+func AllowQuery(config *common.ConfigStruct, ip net.IP, policy *acl.Policy) Decision {
+	if !config.RateLimit.EnableRateLimit {
+		return DecisionPass
+	}
+	rate := config.RateLimit.QueriesPerSec
+	if policy != nil {
+		rate = policy.QueriesPerSec
+	}
+	return queryLimiter.take(clientPrefix(config, ip), rate, config.RateLimit.Slip, config.RateLimit.MaxBuckets)
+}
+
+func AllowResponse(config *common.ConfigStruct, ip net.IP, policy *acl.Policy, respBytes []byte) Decision {
+	if !config.RateLimit.EnableRateLimit {
+		return DecisionPass
+	}
+	rate := config.RateLimit.ResponsesPerSec
+	if policy != nil {
+		rate = policy.ResponsesPerSec
+	}
+	if rate <= 0 {
+		return DecisionPass
+	}
+	parser := dnsmessage.Parser{}
+	header, err := parser.Start(respBytes)
+	if err != nil {
+		return DecisionPass
+	}
+	key := clientPrefix(config, ip) + "|" + header.RCode.String()
+	if question, err := parser.Question(); err == nil {
+		key += "|" + strings.ToLower(question.Name.String()) + "|" + question.Type.String()
+	}
+	return responseLimiter.take(key, rate, config.RateLimit.Slip, config.RateLimit.MaxBuckets)
+}
+
+func clientPrefix(config *common.ConfigStruct, ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return string(ipv4.Mask(net.CIDRMask(config.RateLimit.IPv4PrefixLen, 32)))
+	}
+	return string(ip.To16().Mask(net.CIDRMask(config.RateLimit.IPv6PrefixLen, 128)))
+}
+
+func (limiter *Limiter) take(key string, rate int, slip int, maxBuckets int) Decision {
+	if rate <= 0 {
+		return DecisionPass
+	}
+	now := time.Now().UnixNano()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	b, ok := limiter.buckets[key]
+	if ok {
+		limiter.unlink(b)
+	} else {
+		b = &bucket{key: key, tokens: float64(rate), updateAt: now}
+		limiter.buckets[key] = b
+	}
+	limiter.pushFront(b)
+	for len(limiter.buckets) > maxBuckets && limiter.tail != nil {
+		evictedBucket := limiter.tail
+		limiter.unlink(evictedBucket)
+		delete(limiter.buckets, evictedBucket.key)
+		metrics.RateLimitEvictions.Inc(limiter.kind)
+	}
+	b.tokens += float64(now-b.updateAt) / float64(time.Second) * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.updateAt = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.dropped = 0
+		return DecisionPass
+	}
+	b.dropped++
+	if slip > 0 && b.dropped%slip == 0 {
+		return DecisionSlip
+	}
+	return DecisionDrop
+}
+
+func (limiter *Limiter) clean(idle time.Duration) int {
+	deadline := time.Now().Add(-idle).UnixNano()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	count := 0
+	for limiter.tail != nil && limiter.tail.updateAt < deadline {
+		idleBucket := limiter.tail
+		limiter.unlink(idleBucket)
+		delete(limiter.buckets, idleBucket.key)
+		count++
+	}
+	return count
+}
+
+func (limiter *Limiter) pushFront(b *bucket) {
+	b.prev = nil
+	b.next = limiter.head
+	if limiter.head != nil {
+		limiter.head.prev = b
+	}
+	limiter.head = b
+	if limiter.tail == nil {
+		limiter.tail = b
+	}
+}
+
+func (limiter *Limiter) unlink(b *bucket) {
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else if limiter.head == b {
+		limiter.head = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	} else if limiter.tail == b {
+		limiter.tail = b.prev
+	}
+	b.prev = nil
+	b.next = nil
+}
+
+func cleanLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		queryLimiter.clean(interval)
+		responseLimiter.clean(interval)
+	}
+}
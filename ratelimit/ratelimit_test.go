@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTakeEvictsLeastRecentlyUsed(t *testing.T) {
+	limiter := &Limiter{kind: "test", buckets: make(map[string]*bucket)}
+	for i := 0; i < 10; i++ {
+		limiter.take("key"+strconv.Itoa(i), 1, 0, 4)
+	}
+	if len(limiter.buckets) != 4 {
+		t.Fatalf("got %d buckets, want 4", len(limiter.buckets))
+	}
+	if decision := limiter.take("key6", 1, 0, 4); decision != DecisionDrop {
+		t.Fatalf("got decision %d for a recent key, want drop", decision)
+	}
+	limiter.take("key10", 1, 0, 4)
+	if _, ok := limiter.buckets["key6"]; !ok {
+		t.Fatal("recently used bucket was evicted")
+	}
+	if _, ok := limiter.buckets["key7"]; ok {
+		t.Fatal("least recently used bucket was kept")
+	}
+}
+
+func TestCleanRemovesIdleBuckets(t *testing.T) {
+	limiter := &Limiter{kind: "test", buckets: make(map[string]*bucket)}
+	limiter.take("idle", 1, 0, 4)
+	limiter.buckets["idle"].updateAt = time.Now().Add(-time.Hour).UnixNano()
+	limiter.take("active", 1, 0, 4)
+	if count := limiter.clean(time.Minute); count != 1 {
+		t.Fatalf("cleaned %d buckets, want 1", count)
+	}
+	if _, ok := limiter.buckets["active"]; !ok || limiter.head != limiter.tail {
+		t.Fatal("active bucket was not kept")
+	}
+}
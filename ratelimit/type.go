@@ -0,0 +1,24 @@
+package ratelimit
+
+import (
+	"sync"
+)
+
+type Decision int
+
+type Limiter struct {
+	mutex   sync.Mutex
+	kind    string
+	buckets map[string]*bucket
+	head    *bucket
+	tail    *bucket
+}
+
+type bucket struct {
+	key      string
+	tokens   float64
+	updateAt int64
+	dropped  int
+	prev     *bucket
+	next     *bucket
+}
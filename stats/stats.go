@@ -0,0 +1,262 @@
+package stats
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/querylog"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	windowSeconds  = 10 * 60
+	windowCount    = 6
+	historySeconds = windowSeconds * windowCount
+	currentSeconds = 10
+)
+
+var collector *Collector
+
+func Init() error {
+	if !common.Config.Stats.EnableStats {
+		return nil
+	}
+	if common.Config.Stats.MaxTrackedNames < 1 {
+		return errors.New("max tracked names " + strconv.Itoa(common.Config.Stats.MaxTrackedNames) + " is not correct")
+	}
+	if common.Config.Stats.RecentQueries < 0 {
+		return errors.New("recent queries " + strconv.Itoa(common.Config.Stats.RecentQueries) + " is not correct")
+	}
+	collector = &Collector{
+		recent: make([]*querylog.Entry, common.Config.Stats.RecentQueries),
+	}
+	return nil
+}
+
+func Enabled() bool {
+	return collector != nil
+}
+
+func RecordQuery(entry *querylog.Entry, client string, blocked bool) {
+	if collector == nil {
+		return
+	}
+	name := strings.ToLower(entry.Name)
+	now := time.Now().Unix()
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	slot := &collector.seconds[now%historySeconds]
+	if slot.second != now {
+		slot.second = now
+		slot.count = 0
+	}
+	slot.count++
+	w := collector.currentWindow(now)
+	w.queries++
+	increase(w.domains, name)
+	if blocked {
+		increase(w.blocked, name)
+	}
+	if client != "" {
+		increase(w.clients, client)
+	}
+	if entry.Cache != "" {
+		w.cache[entry.Cache]++
+	}
+	if len(collector.recent) > 0 {
+		collector.recent[collector.recentIndex] = entry
+		collector.recentIndex = (collector.recentIndex + 1) % len(collector.recent)
+	}
+}
+
+func RecentQueries(search string, limit int) []*querylog.Entry {
+	entries := make([]*querylog.Entry, 0)
+	if collector == nil {
+		return entries
+	}
+	search = strings.ToLower(search)
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	for i := 1; i <= len(collector.recent) && len(entries) < limit; i++ {
+		entry := collector.recent[(collector.recentIndex-i+len(collector.recent))%len(collector.recent)]
+		if entry == nil {
+			break
+		}
+		if search != "" && !strings.Contains(strings.ToLower(entry.Name), search) && !strings.Contains(entry.Client, search) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func RecordUpstream(upstream string, latency time.Duration, failed bool) {
+	if collector == nil {
+		return
+	}
+	now := time.Now().Unix()
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	w := collector.currentWindow(now)
+	counter := w.upstreams[upstream]
+	if counter == nil {
+		counter = &upstreamCounter{}
+		w.upstreams[upstream] = counter
+	}
+	counter.requests++
+	if failed {
+		counter.failures++
+	} else {
+		counter.latencyNs += latency.Nanoseconds()
+	}
+}
+
+func GetReport(top int) *Report {
+	if collector == nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	merged := newWindow(now)
+	report := &Report{
+		QPSHistory: make([]*QPSPoint, 0, windowCount*10),
+	}
+	collector.mutex.Lock()
+	for _, w := range collector.windows {
+		if w == nil || w.startAt <= now-historySeconds {
+			continue
+		}
+		if w.startAt < merged.startAt {
+			merged.startAt = w.startAt
+		}
+		merged.queries += w.queries
+		mergeCounts(merged.domains, w.domains)
+		mergeCounts(merged.blocked, w.blocked)
+		mergeCounts(merged.clients, w.clients)
+		mergeCounts(merged.cache, w.cache)
+		for upstream, counter := range w.upstreams {
+			mergedCounter := merged.upstreams[upstream]
+			if mergedCounter == nil {
+				mergedCounter = &upstreamCounter{}
+				merged.upstreams[upstream] = mergedCounter
+			}
+			mergedCounter.requests += counter.requests
+			mergedCounter.failures += counter.failures
+			mergedCounter.latencyNs += counter.latencyNs
+		}
+	}
+	minuteStart := now - now%60 - historySeconds + 60
+	for minute := minuteStart; minute <= now; minute += 60 {
+		count := uint64(0)
+		for second := minute; second < minute+60 && second <= now; second++ {
+			count += collector.countAt(second)
+		}
+		seconds := common.IntMin(60, int(now-minute)+1)
+		report.QPSHistory = append(report.QPSHistory, &QPSPoint{
+			Time: time.Unix(minute, 0).Format(time.RFC3339),
+			QPS:  float64(count) / float64(seconds),
+		})
+	}
+	currentCount := uint64(0)
+	for second := now - currentSeconds; second < now; second++ {
+		currentCount += collector.countAt(second)
+	}
+	collector.mutex.Unlock()
+
+	report.WindowStart = time.Unix(merged.startAt, 0).Format(time.RFC3339)
+	report.Queries = merged.queries
+	report.CurrentQPS = float64(currentCount) / currentSeconds
+	report.Cache = &CacheReport{
+		Hits:      merged.cache[cache.StatusHit],
+		StaleHits: merged.cache[cache.StatusStale],
+		Misses:    merged.cache[cache.StatusMiss],
+	}
+	if lookups := report.Cache.Hits + report.Cache.StaleHits + report.Cache.Misses; lookups > 0 {
+		report.Cache.HitRatio = float64(report.Cache.Hits+report.Cache.StaleHits) / float64(lookups)
+	}
+	report.TopDomains = topCounts(merged.domains, top)
+	report.TopBlocked = topCounts(merged.blocked, top)
+	report.TopClients = topCounts(merged.clients, top)
+	report.Upstreams = make([]*UpstreamStats, 0, len(merged.upstreams))
+	for upstream, counter := range merged.upstreams {
+		upstreamStats := &UpstreamStats{
+			Upstream:    upstream,
+			Requests:    counter.requests,
+			Failures:    counter.failures,
+			FailureRate: float64(counter.failures) / float64(counter.requests),
+		}
+		if succeeded := counter.requests - counter.failures; succeeded > 0 {
+			upstreamStats.AvgLatencyMs = float64(counter.latencyNs) / float64(succeeded) / float64(time.Millisecond)
+		}
+		report.Upstreams = append(report.Upstreams, upstreamStats)
+	}
+	sort.Slice(report.Upstreams, func(i, j int) bool {
+		return report.Upstreams[i].Upstream < report.Upstreams[j].Upstream
+	})
+	return report
+}
+
+func (collector *Collector) currentWindow(now int64) *window {
+	startAt := now - now%windowSeconds
+	index := (startAt / windowSeconds) % windowCount
+	w := collector.windows[index]
+	if w == nil || w.startAt != startAt {
+		w = newWindow(startAt)
+		collector.windows[index] = w
+	}
+	return w
+}
+
+func (collector *Collector) countAt(second int64) uint64 {
+	if second < 0 {
+		return 0
+	}
+	slot := collector.seconds[second%historySeconds]
+	if slot.second != second {
+		return 0
+	}
+	return slot.count
+}
+
+func newWindow(startAt int64) *window {
+	return &window{
+		startAt:   startAt,
+		domains:   make(map[string]uint64),
+		blocked:   make(map[string]uint64),
+		clients:   make(map[string]uint64),
+		cache:     make(map[string]uint64),
+		upstreams: make(map[string]*upstreamCounter),
+	}
+}
+
+func increase(counts map[string]uint64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= common.Config.Stats.MaxTrackedNames {
+		return
+	}
+	counts[key]++
+}
+
+func mergeCounts(dst map[string]uint64, src map[string]uint64) {
+	for key, count := range src {
+		dst[key] += count
+	}
+}
+
+func topCounts(counts map[string]uint64, top int) []*NameCount {
+	list := make([]*NameCount, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, &NameCount{Name: name, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	if top >= 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
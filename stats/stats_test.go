@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"accdns/cache"
+	"accdns/common"
+	"accdns/querylog"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startTestCollector(t *testing.T, maxTrackedNames int, recentQueries int) {
+	oldConfig := common.Config.Stats
+	common.Config.Stats = &common.StatsConfig{EnableStats: true, MaxTrackedNames: maxTrackedNames, RecentQueries: recentQueries}
+	t.Cleanup(func() {
+		common.Config.Stats = oldConfig
+		collector = nil
+	})
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurrentWindowRollsOver(t *testing.T) {
+	testCollector := &Collector{}
+	startAt := int64(windowSeconds * 100)
+	first := testCollector.currentWindow(startAt)
+	first.queries = 5
+	if w := testCollector.currentWindow(startAt + windowSeconds - 1); w != first {
+		t.Fatal("query in the same ten minutes got a new window")
+	}
+	second := testCollector.currentWindow(startAt + windowSeconds)
+	if second == first || second.startAt != startAt+windowSeconds || testCollector.windows[(startAt/windowSeconds)%windowCount] != first {
+		t.Fatal("next ten minutes did not get its own window")
+	}
+	reused := testCollector.currentWindow(startAt + historySeconds)
+	if reused == first || reused.queries != 0 || testCollector.windows[(startAt/windowSeconds)%windowCount] != reused {
+		t.Fatal("window an hour later did not replace the expired one")
+	}
+}
+
+func TestReportSkipsExpiredWindows(t *testing.T) {
+	startTestCollector(t, 100, 0)
+	now := time.Now().Unix()
+	kept := collector.currentWindow(now - 2*windowSeconds)
+	kept.queries = 7
+	kept.domains["kept.example."] = 7
+	kept.cache[cache.StatusHit] = 6
+	kept.cache[cache.StatusMiss] = 1
+	expiredStart := now - now%windowSeconds - historySeconds - windowSeconds
+	expired := newWindow(expiredStart)
+	expired.queries = 100
+	expired.domains["expired.example."] = 100
+	collector.windows[((now-windowSeconds)/windowSeconds)%windowCount] = expired
+	RecordQuery(&querylog.Entry{Name: "Current.Example.", Cache: cache.StatusStale}, "192.0.2.1", true)
+	report := GetReport(10)
+	if report.Queries != 8 {
+		t.Fatalf("got %d queries, want 8", report.Queries)
+	}
+	if len(report.TopDomains) != 2 || report.TopDomains[0].Name != "kept.example." || report.TopDomains[1].Name != "current.example." {
+		t.Fatalf("got top domains %v", report.TopDomains)
+	}
+	if len(report.TopBlocked) != 1 || len(report.TopClients) != 1 || report.TopClients[0].Name != "192.0.2.1" {
+		t.Fatalf("got blocked %v and clients %v", report.TopBlocked, report.TopClients)
+	}
+	if report.Cache.Hits != 6 || report.Cache.StaleHits != 1 || report.Cache.Misses != 1 || report.Cache.HitRatio != 7.0/8 {
+		t.Fatalf("got cache report %+v", report.Cache)
+	}
+	if report.WindowStart != time.Unix(now-now%windowSeconds-2*windowSeconds, 0).Format(time.RFC3339) {
+		t.Fatalf("report starts at %s", report.WindowStart)
+	}
+}
+
+func TestQPSIgnoresStaleSeconds(t *testing.T) {
+	startTestCollector(t, 100, 0)
+	now := time.Now().Unix()
+	collector.seconds[(now-1)%historySeconds] = secondCount{second: now - 1, count: 20}
+	collector.seconds[(now-2)%historySeconds] = secondCount{second: now - 2 - historySeconds, count: 1000}
+	report := GetReport(10)
+	if report.CurrentQPS != 2 {
+		t.Fatalf("got current qps %v, want 2", report.CurrentQPS)
+	}
+	if len(report.QPSHistory) != windowCount*10 {
+		t.Fatalf("got %d qps points, want %d", len(report.QPSHistory), windowCount*10)
+	}
+	total := 0.0
+	for _, point := range report.QPSHistory {
+		total += point.QPS
+	}
+	if total <= 0 || total > 20 {
+		t.Fatalf("qps history adds up to %v", total)
+	}
+}
+
+func TestTrackedNamesAreCapped(t *testing.T) {
+	startTestCollector(t, 3, 0)
+	for i := 0; i < 10; i++ {
+		RecordQuery(&querylog.Entry{Name: "host" + strconv.Itoa(i) + ".example."}, "", false)
+	}
+	RecordQuery(&querylog.Entry{Name: "host0.example."}, "", false)
+	report := GetReport(-1)
+	if report.Queries != 11 || len(report.TopDomains) != 3 || report.TopDomains[0].Name != "host0.example." || report.TopDomains[0].Count != 2 {
+		t.Fatalf("got %d queries and top domains %v", report.Queries, report.TopDomains)
+	}
+}
+
+func TestRecentQueries(t *testing.T) {
+	startTestCollector(t, 100, 3)
+	for i := 0; i < 5; i++ {
+		RecordQuery(&querylog.Entry{Name: "host" + strconv.Itoa(i) + ".example.", Client: "192.0.2." + strconv.Itoa(i)}, "", false)
+	}
+	entries := RecentQueries("", 10)
+	if len(entries) != 3 || entries[0].Name != "host4.example." || entries[2].Name != "host2.example." {
+		t.Fatalf("got %d recent queries", len(entries))
+	}
+	if entries := RecentQueries("HOST3", 10); len(entries) != 1 || entries[0].Client != "192.0.2.3" {
+		t.Fatalf("got %v, want host3", entries)
+	}
+	if entries := RecentQueries("", 1); len(entries) != 1 {
+		t.Fatalf("got %d entries, want the limit of 1", len(entries))
+	}
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"accdns/querylog"
+	"sync"
+)
+
+type Collector struct {
+	mutex       sync.Mutex
+	windows     [windowCount]*window
+	seconds     [historySeconds]secondCount
+	recent      []*querylog.Entry
+	recentIndex int
+}
+
+type window struct {
+	startAt   int64
+	queries   uint64
+	domains   map[string]uint64
+	blocked   map[string]uint64
+	clients   map[string]uint64
+	cache     map[string]uint64
+	upstreams map[string]*upstreamCounter
+}
+
+type secondCount struct {
+	second int64
+	count  uint64
+}
+
+type upstreamCounter struct {
+	requests  uint64
+	failures  uint64
+	latencyNs int64
+}
+
+type Report struct {
+	WindowStart string           `json:"window_start"`
+	Queries     uint64           `json:"queries"`
+	CurrentQPS  float64          `json:"current_qps"`
+	QPSHistory  []*QPSPoint      `json:"qps_history"`
+	Cache       *CacheReport     `json:"cache"`
+	TopDomains  []*NameCount     `json:"top_domains"`
+	TopBlocked  []*NameCount     `json:"top_blocked"`
+	TopClients  []*NameCount     `json:"top_clients"`
+	Upstreams   []*UpstreamStats `json:"upstreams"`
+}
+
+type QPSPoint struct {
+	Time string  `json:"time"`
+	QPS  float64 `json:"qps"`
+}
+
+type CacheReport struct {
+	Hits      uint64  `json:"hits"`
+	StaleHits uint64  `json:"stale_hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+type NameCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type UpstreamStats struct {
+	Upstream     string  `json:"upstream"`
+	Requests     uint64  `json:"requests"`
+	Failures     uint64  `json:"failures"`
+	FailureRate  float64 `json:"failure_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}